@@ -1 +1,2 @@
-export { fetch } from "./turnx.js";
+export { fetch, receive, TurnxStream } from "./turnx.js";
+export type { Server, TurnxServer } from "./turnx.js";
@@ -44,12 +44,25 @@ function parseIPv6(address: string) {
 const encoder = new TextEncoder();
 const decoder = new TextDecoder();
 
-async function turnpoke(server: string, req: string, timeout?: number): Promise<Uint8Array> {
+// TurnxServer is the address of a turnx server with TURN REST API
+// credentials, which the backend mints for its users: username is
+// "<expiry>:<user>" and credential the base64 HMAC-SHA1 of it.
+export interface TurnxServer {
+	address: string;
+	username?: string;
+	credential?: string;
+}
+
+// Server is a turnx server, or just its address to use the shared password.
+export type Server = string | TurnxServer;
+
+async function turnpoke(server: Server, req: string, timeout?: number): Promise<Uint8Array> {
+	const opts: TurnxServer = typeof server === "string" ? { address: server } : server;
 	const pc = new RTCPeerConnection({
 		iceServers: [{
-			urls: "turn:" + server,
-			username: `turnrpc:${req}`,
-			credential: "turnrpc",
+			urls: "turn:" + opts.address,
+			username: opts.username ? `${opts.username}:turnrpc:${req}` : `turnrpc:${req}`,
+			credential: opts.credential ?? "turnrpc",
 		}],
 		iceTransportPolicy: "relay",
 	});
@@ -268,9 +281,137 @@ for (let i = 0; i < dictStr.length; i += 1) {
 	dict[i] = dictStr.charCodeAt(i);
 }
 
-export async function turnrpc(server: string, req: Uint8Array | ArrayBufferLike, timeout?: number): Promise<ArrayBuffer>;
-export async function turnrpc(server: string, req: string, timeout?: number): Promise<string>;
-export async function turnrpc(server: string, req: Uint8Array | ArrayBufferLike | string, timeout?: number): Promise<ArrayBuffer | string> {
+const initialPollDelay = 50;
+const maxPollDelay = 1000;
+
+// e: starts the request in the background and p: polls it. The first byte of
+// their replies is 0 while pending, 1 when done followed by the 4 byte length
+// of the response, and 2 when the backend failed. Older servers answer e:
+// with the length directly.
+async function waitResponse(server: Server, b64id: string, timeout?: number, method = "e"): Promise<number> {
+	let reply = await turnpoke(server, `${method}:${b64id}`, timeout);
+	let delay = initialPollDelay;
+	for (;;) {
+		const view = new DataView(reply.buffer, reply.byteOffset, reply.byteLength);
+		if (reply.byteLength === 4) {
+			return view.getUint32(0, false);
+		}
+		if (reply.byteLength === 5 && reply[0] === 1) {
+			return view.getUint32(1, false);
+		}
+		if (reply.byteLength === 1 && reply[0] === 2) {
+			throw new Error("Backend failed");
+		}
+		if (reply.byteLength !== 1 || reply[0] !== 0) {
+			throw new Error("Invalid execution status");
+		}
+		await new Promise((resolve) => setTimeout(resolve, delay));
+		delay = Math.min(delay * 2, maxPollDelay);
+		reply = await turnpoke(server, `p:${b64id}`, timeout);
+	}
+}
+
+async function readRange(server: Server, b64id: string, from: number, to: number, timeout?: number): Promise<Uint8Array> {
+	const respBuf = new Uint8Array(to - from);
+	const retrieveJobs: (() => Promise<unknown>)[] = [];
+	for (let i = from; i < to; i += 16) {
+		retrieveJobs.push(
+			() => turnpoke(server, `r:${b64id}:${i}`, timeout).then((part) => {
+				respBuf.set(part.subarray(0, to - i), i - from);
+			})
+		);
+	}
+	while (retrieveJobs.length > 0) {
+		const batch = retrieveJobs.splice(0, batchSize);
+		await Promise.all(batch.map((job) => job()));
+	}
+	return respBuf;
+}
+
+// receive takes the next message from a mailbox the backend publishes to,
+// or returns undefined if the mailbox is empty.
+export async function receive(server: Server, name: string, timeout?: number): Promise<Uint8Array | undefined> {
+	const id = await turnpoke(server, `q:${name}`, timeout);
+	if (id.byteLength === 0) {
+		return undefined;
+	}
+	const b64id = b64(id);
+	const len = await waitResponse(server, b64id, timeout, "p");
+	return readRange(server, b64id, 0, len, timeout);
+}
+
+// TurnxStream is a stream session: what is written reaches the server's
+// stream backend, and what the backend sends is read back in order. With a
+// WebSocket backend, messages are framed with a 4 byte big-endian length
+// whose top bit marks text messages. With a UDP backend, every write is sent
+// as one datagram and must fit a single chunk.
+export class TurnxStream {
+	private writeOffset = 0;
+	private readOffset = 0;
+
+	private constructor(
+		private server: Server,
+		private b64id: string,
+		private datagrams: boolean,
+		private timeout?: number,
+	) {}
+
+	static async open(server: Server, timeout?: number): Promise<TurnxStream> {
+		// byte 10 of the capability record flags datagram stream backends
+		const caps = await turnpoke(server, "v:", timeout);
+		const datagrams = caps.byteLength > 10 && (caps[10] & 1) !== 0;
+		const id = await turnpoke(server, "o:", timeout);
+		return new TurnxStream(server, b64(id), datagrams, timeout);
+	}
+
+	async write(data: Uint8Array): Promise<void> {
+		if (this.datagrams && data.byteLength > reqPartSize) {
+			throw new Error("Datagram too long");
+		}
+		const offset = this.writeOffset;
+		this.writeOffset += data.byteLength;
+		const jobs: (() => Promise<unknown>)[] = [];
+		for (let i = 0; i < data.byteLength; i += reqPartSize) {
+			const part = data.slice(i, i + reqPartSize);
+			jobs.push(() => turnpoke(this.server, `w:${this.b64id}:${offset + i}:${b64(part)}`, this.timeout));
+		}
+		while (jobs.length > 0) {
+			const batch = jobs.splice(0, batchSize);
+			await Promise.all(batch.map((job) => job()));
+		}
+	}
+
+	// read waits for data from the backend, and returns undefined once the
+	// stream has ended.
+	async read(): Promise<Uint8Array | undefined> {
+		let delay = initialPollDelay;
+		for (;;) {
+			const reply = await turnpoke(this.server, `p:${this.b64id}:${this.readOffset}`, this.timeout);
+			if (reply.byteLength !== 5) {
+				throw new Error("Invalid stream status");
+			}
+			const end = new DataView(reply.buffer, reply.byteOffset).getUint32(1, false);
+			if (end > this.readOffset) {
+				const data = await readRange(this.server, this.b64id, this.readOffset, end, this.timeout);
+				this.readOffset = end;
+				return data;
+			}
+			if (reply[0] === 4) {
+				return undefined;
+			}
+			await new Promise((resolve) => setTimeout(resolve, delay));
+			delay = Math.min(delay * 2, maxPollDelay);
+		}
+	}
+
+	async close(): Promise<void> {
+		await turnpoke(this.server, `x:${this.b64id}`, this.timeout);
+	}
+}
+
+export async function turnrpc(server: Server, req: Uint8Array | ArrayBufferLike, timeout?: number): Promise<ArrayBuffer>;
+export async function turnrpc(server: Server, req: string, timeout?: number): Promise<string>;
+export async function turnrpc(server: Server, req: Uint8Array | ArrayBufferLike | string, timeout?: number): Promise<ArrayBuffer | string> {
 	const buf = new Uint8Array(typeof req === "string" ? encoder.encode(req) : req);
 	// compress the request using the preset dictionary
 	const compedParts: Uint8Array[] = [];
@@ -290,46 +431,28 @@ export async function turnrpc(server: string, req: Uint8Array | ArrayBufferLike
 	const b64id = b64(id);
 
 	// send the request parts
-	const reqParts = [];
+	const reqParts: [number, Uint8Array][] = [];
 	for (let i = 0; i < comped.byteLength; i += reqPartSize) {
-		reqParts.push(comped.slice(i, i + reqPartSize));
+		reqParts.push([i, comped.slice(i, i + reqPartSize)]);
 	}
 	while (reqParts.length > 0) {
 		const batch = reqParts.splice(0, batchSize);
 		const reqPartPromises: Promise<unknown>[] = [];
-		for (let i = 0; i < batch.length; i++) {
-			const part = batch[i];
+		for (const [offset, part] of batch) {
 			reqPartPromises.push(turnpoke(
 				server,
-				`c:${b64id}:${i * reqPartSize}:${b64(part)}`,
+				`c:${b64id}:${offset}:${b64(part)}`,
 				timeout,
 			));
 		}
 		await Promise.all(reqPartPromises);
 	}
 
-	// execute the request
-	const respLenBuf = await turnpoke(server, `e:${b64id}`, timeout);
-	if (respLenBuf.byteLength !== 4) {
-		throw new Error("Invalid response length");
-	}
-	const respLenView = new DataView(respLenBuf.buffer);
-	const respLen = respLenView.getUint32(0, false);
+	// execute the request and wait for the response
+	const respLen = await waitResponse(server, b64id, timeout);
 
 	// retrieve the response parts
-	const respBuf = new Uint8Array(respLen);
-	const retrieveJobs: (() => Promise<unknown>)[] = [];
-	for (let i = 0; i < respLen; i += 16) {
-		retrieveJobs.push(
-			() => turnpoke(server, `r:${b64id}:${i}`, timeout).then((part) => {
-				respBuf.set(part, i);
-			})
-		);
-	}
-	while (retrieveJobs.length > 0) {
-		const batch = retrieveJobs.splice(0, batchSize);
-		await Promise.all(batch.map((job) => job()));
-	}
+	const respBuf = await readRange(server, b64id, 0, respLen, timeout);
 	let decompedParts: Uint8Array[] = [];
 	const unzlib = new Unzlib({
 		dictionary: dict,
@@ -348,7 +471,8 @@ export async function turnrpc(server: string, req: Uint8Array | ArrayBufferLike
 
 const localhosts = new Set(["localhost", "127.0.0.1", "::1"]);
 
-export async function fetch(url: string | URL | Request, init?: FetchRequestInit): Promise<Response> {
+// fetch sends a turnx:// request. init.turnx holds the credentials to use.
+export async function fetch(url: string | URL | Request, init?: FetchRequestInit & { turnx?: Omit<TurnxServer, "address"> }): Promise<Response> {
 	let req = new Request(url, init);
 	let u = new URL(req.url);
 	if (u.protocol !== "turnx:") {
@@ -365,7 +489,7 @@ export async function fetch(url: string | URL | Request, init?: FetchRequestInit
 		);
 	}
 	const reqBuf = await serializeHTTP(req);
-	const respBuf = await turnrpc(u.host, reqBuf);
+	const respBuf = await turnrpc({ ...init?.turnx, address: u.host }, reqBuf);
 	const resp = await parseHTTPResponse(respBuf);
 	return resp;
 }
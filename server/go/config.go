@@ -0,0 +1,349 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/gyf304/webrtcsocket/server/turnx"
+	"gopkg.in/yaml.v3"
+)
+
+// config is the file read with -config. See config.example.yaml.
+type config struct {
+	// Listen lists the UDP addresses to serve turnrpc on.
+	Listen []string `yaml:"listen"`
+	// Admin is the address of the admin API, disabled if empty.
+	Admin string `yaml:"admin"`
+
+	// Backends names the backends, by target URL.
+	Backends map[string]backendConfig `yaml:"backends"`
+	// Backend names the backend executing requests no route matches.
+	Backend string `yaml:"backend"`
+	// Stream names the backend of stream sessions.
+	Stream string `yaml:"stream"`
+	// Routes are tried in order before Backend.
+	Routes []routeConfig `yaml:"routes"`
+
+	Auth struct {
+		Realm          string `yaml:"realm"`
+		Software       string `yaml:"software"`
+		UsernamePrefix string `yaml:"username_prefix"`
+		Password       string `yaml:"password"`
+		// Secret switches to TURN REST API credentials minted with it.
+		Secret string        `yaml:"secret"`
+		MaxTTL time.Duration `yaml:"max_ttl"`
+		// Users switches to the users of a coturn-style user file,
+		// reloaded when it changes. Their "backend" attribute restricts
+		// them to the named backends.
+		Users string `yaml:"users"`
+		// NonceSecret lets servers behind one address accept each
+		// other's nonces.
+		NonceSecret string `yaml:"nonce_secret"`
+	} `yaml:"auth"`
+
+	Limits struct {
+		Validity       time.Duration `yaml:"validity"`
+		NonceValidity  time.Duration `yaml:"nonce_validity"`
+		HTTPTimeout    time.Duration `yaml:"http_timeout"`
+		MaxRequestSize int           `yaml:"max_request_size"`
+		CacheSize      int           `yaml:"cache_size"`
+		// Rate holds token buckets, of rate tokens per second up to
+		// burst, per source IP, user and session.
+		Rate struct {
+			IP      rateConfig `yaml:"ip"`
+			User    rateConfig `yaml:"user"`
+			Session rateConfig `yaml:"session"`
+		} `yaml:"rate"`
+	} `yaml:"limits"`
+
+	// Dictionaries lists compression dictionary files, preferred first.
+	Dictionaries []string `yaml:"dictionaries"`
+
+	Logging struct {
+		// Output is stderr, stdout, discard or the path of a file to
+		// append to. Defaults to stderr.
+		Output string `yaml:"output"`
+		// Timestamps prefixes every line with the date and time.
+		// Defaults to true.
+		Timestamps *bool `yaml:"timestamps"`
+	} `yaml:"logging"`
+}
+
+type backendConfig struct {
+	// Target is a HTTP(S), WebSocket (ws, wss), tcp://host:port or
+	// udp://host:port address.
+	Target string `yaml:"target"`
+	// Timeout bounds HTTP requests, overriding limits.http_timeout.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type rateConfig struct {
+	Pokes    turnx.RateLimit `yaml:"pokes"`
+	Executes turnx.RateLimit `yaml:"executes"`
+}
+
+type routeConfig struct {
+	Host        string `yaml:"host"`
+	Prefix      string `yaml:"prefix"`
+	StripPrefix bool   `yaml:"strip_prefix"`
+	Backend     string `yaml:"backend"`
+}
+
+// loadConfig reads and validates the config file at path.
+func loadConfig(path string) (*config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c := &config{}
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// validate reports every problem of c at once.
+func (c *config) validate() error {
+	var errs []error
+	fail := func(format string, a ...any) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+	if len(c.Listen) == 0 {
+		fail("listen: at least one address is required")
+	}
+	names := make([]string, 0, len(c.Backends))
+	for name := range c.Backends {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		b := c.Backends[name]
+		u, err := url.Parse(b.Target)
+		switch {
+		case err != nil:
+			fail("backends.%s.target: %v", name, err)
+		case backendKind(u) == "":
+			fail("backends.%s.target: %q is not a HTTP(S), WebSocket, TCP or UDP address", name, b.Target)
+		}
+		if b.Timeout < 0 {
+			fail("backends.%s.timeout: must not be negative", name)
+		}
+	}
+	checkRef := func(field, name, kind string) {
+		b, ok := c.Backends[name]
+		if !ok {
+			fail("%s: unknown backend %q", field, name)
+			return
+		}
+		if u, err := url.Parse(b.Target); err == nil && backendKind(u) != kind && backendKind(u) != "" {
+			fail("%s: backend %q is not %s backend", field, name, map[string]string{"http": "an HTTP", "stream": "a stream"}[kind])
+		}
+	}
+	if c.Backend != "" {
+		checkRef("backend", c.Backend, "http")
+	}
+	if c.Stream != "" {
+		checkRef("stream", c.Stream, "stream")
+	}
+	for i, r := range c.Routes {
+		checkRef(fmt.Sprintf("routes[%d].backend", i), r.Backend, "http")
+		if r.Prefix != "" && r.Prefix[0] != '/' {
+			fail("routes[%d].prefix: must start with /", i)
+		}
+	}
+	if c.Backend == "" && c.Stream == "" && len(c.Routes) == 0 {
+		fail("backend: at least one of backend, stream and routes is required")
+	}
+	if n := countSet(c.Auth.Password, c.Auth.Secret, c.Auth.Users); n > 1 {
+		fail("auth: password, secret and users are exclusive")
+	}
+	if c.Auth.MaxTTL < 0 {
+		fail("auth.max_ttl: must not be negative")
+	}
+	if c.Limits.Validity < 0 {
+		fail("limits.validity: must not be negative")
+	}
+	if c.Limits.NonceValidity < 0 {
+		fail("limits.nonce_validity: must not be negative")
+	}
+	if c.Limits.HTTPTimeout < 0 {
+		fail("limits.http_timeout: must not be negative")
+	}
+	if c.Limits.MaxRequestSize < 0 {
+		fail("limits.max_request_size: must not be negative")
+	}
+	if c.Limits.CacheSize < 0 {
+		fail("limits.cache_size: must not be negative")
+	}
+	for _, r := range []struct {
+		name string
+		rate rateConfig
+	}{{"ip", c.Limits.Rate.IP}, {"user", c.Limits.Rate.User}, {"session", c.Limits.Rate.Session}} {
+		if r.rate.Pokes.Rate < 0 || r.rate.Pokes.Burst < 0 {
+			fail("limits.rate.%s.pokes: must not be negative", r.name)
+		}
+		if r.rate.Executes.Rate < 0 || r.rate.Executes.Burst < 0 {
+			fail("limits.rate.%s.executes: must not be negative", r.name)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func countSet(values ...string) int {
+	n := 0
+	for _, v := range values {
+		if v != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// backendKind returns "http" or "stream" for the targets newBackend
+// accepts, and "" for the others.
+func backendKind(u *url.URL) string {
+	switch u.Scheme {
+	case "http", "https":
+		return "http"
+	case "ws", "wss", "tcp", "udp":
+		return "stream"
+	}
+	return ""
+}
+
+// newBackend returns the backend for target u, as either a Backend or a
+// StreamBackend. A zero timeout keeps the default HTTP client.
+func newBackend(u *url.URL, timeout time.Duration) (turnx.Backend, turnx.StreamBackend) {
+	switch u.Scheme {
+	case "http", "https":
+		b := &turnx.HTTPBackend{Target: u}
+		if timeout > 0 {
+			b.Client = &http.Client{Timeout: timeout}
+		}
+		return b, nil
+	case "ws", "wss":
+		return nil, &turnx.WebSocketBackend{Target: u}
+	case "tcp":
+		return nil, &turnx.TCPBackend{Addr: u.Host}
+	case "udp":
+		return nil, &turnx.UDPBackend{Addr: u.Host}
+	}
+	return nil, nil
+}
+
+// options builds the server options of a validated config.
+func (c *config) options() (turnx.Options, error) {
+	opts := turnx.Options{
+		Realm:          c.Auth.Realm,
+		Password:       c.Auth.Password,
+		Software:       c.Auth.Software,
+		UsernamePrefix: c.Auth.UsernamePrefix,
+		Validity:       c.Limits.Validity,
+		NonceValidity:  c.Limits.NonceValidity,
+		MaxRequestSize: c.Limits.MaxRequestSize,
+		CacheSize:      c.Limits.CacheSize,
+		RateLimits: turnx.RateLimits{
+			IPPokes:         c.Limits.Rate.IP.Pokes,
+			IPExecutes:      c.Limits.Rate.IP.Executes,
+			UserPokes:       c.Limits.Rate.User.Pokes,
+			UserExecutes:    c.Limits.Rate.User.Executes,
+			SessionPokes:    c.Limits.Rate.Session.Pokes,
+			SessionExecutes: c.Limits.Rate.Session.Executes,
+		},
+	}
+	if c.Auth.NonceSecret != "" {
+		opts.NonceSecret = []byte(c.Auth.NonceSecret)
+	}
+	var err error
+	opts.ErrorLog, err = c.logger()
+	if err != nil {
+		return opts, err
+	}
+	switch {
+	case c.Auth.Secret != "":
+		opts.Auth = &turnx.RESTAuth{Secret: []byte(c.Auth.Secret), MaxTTL: c.Auth.MaxTTL}
+	case c.Auth.Users != "":
+		opts.Auth, err = turnx.NewUserFile(c.Auth.Users, opts.ErrorLog)
+		if err != nil {
+			return opts, err
+		}
+	}
+	backend := func(name string) (turnx.Backend, turnx.StreamBackend) {
+		b := c.Backends[name]
+		u, _ := url.Parse(b.Target)
+		timeout := b.Timeout
+		if timeout == 0 {
+			timeout = c.Limits.HTTPTimeout
+		}
+		return newBackend(u, timeout)
+	}
+	if c.Backend != "" {
+		opts.Backend, _ = backend(c.Backend)
+	}
+	if c.Stream != "" {
+		_, opts.StreamBackend = backend(c.Stream)
+	}
+	if len(c.Routes) > 0 || c.Auth.Users != "" && opts.Backend != nil {
+		// the default backend is a last route rather than the Default of
+		// the Router, so that users can be restricted to it by name
+		router := &turnx.Router{}
+		for _, r := range c.Routes {
+			b, _ := backend(r.Backend)
+			router.Routes = append(router.Routes, turnx.Route{
+				Name:        r.Backend,
+				Host:        r.Host,
+				PathPrefix:  r.Prefix,
+				StripPrefix: r.StripPrefix,
+				Backend:     b,
+			})
+		}
+		if c.Backend != "" {
+			router.Routes = append(router.Routes, turnx.Route{Name: c.Backend, Backend: opts.Backend})
+		}
+		opts.Backend = router
+	}
+	for _, name := range c.Dictionaries {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return opts, err
+		}
+		opts.Dictionaries = append(opts.Dictionaries, b)
+	}
+	return opts, nil
+}
+
+func (c *config) logger() (*log.Logger, error) {
+	flags := log.LstdFlags
+	if c.Logging.Timestamps != nil && !*c.Logging.Timestamps {
+		flags = 0
+	}
+	var w io.Writer
+	switch c.Logging.Output {
+	case "", "stderr":
+		w = os.Stderr
+	case "stdout":
+		w = os.Stdout
+	case "discard":
+		w = io.Discard
+	default:
+		f, err := os.OpenFile(c.Logging.Output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	return log.New(w, "", flags), nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gyf304/webrtcsocket/server/turnx"
+)
+
+// writeFile writes data to a new file in a temporary directory and returns
+// its path.
+func writeFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	c, err := loadConfig("config.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Backend != "web" || c.Stream != "chat" || len(c.Routes) != 2 || c.Backends["api"].Timeout != 5*time.Second {
+		t.Errorf("got %+v", c)
+	}
+
+	for _, tc := range []struct{ name, yaml, err string }{
+		{"empty", "", "listen: at least one address is required"},
+		{"unknown field", "listen: [':3478']\nbackend: web\nbackends: {web: {target: 'http://x'}}\nlisten_on: ':3479'\n", "field listen_on not found"},
+		{"unknown nested field", "listen: [':3478']\nauth: {pasword: x}\n", "field pasword not found"},
+		{"wrong type", "listen: ':3478'\n", "cannot unmarshal"},
+	} {
+		_, err := loadConfig(writeFile(t, "config.yaml", tc.yaml))
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: got %v, want %q", tc.name, err, tc.err)
+		}
+	}
+	if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml")); !os.IsNotExist(err) {
+		t.Errorf("missing file: got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *config {
+		return &config{
+			Listen:   []string{":3478"},
+			Backends: map[string]backendConfig{"web": {Target: "http://127.0.0.1:8000"}, "chat": {Target: "wss://chat.example/socket"}},
+			Backend:  "web",
+		}
+	}
+	if err := valid().validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		modify func(c *config)
+		errs   []string
+	}{
+		{"no listen", func(c *config) { c.Listen = nil }, []string{"listen: at least one address is required"}},
+		{"no backend", func(c *config) { c.Backend = "" }, []string{"backend: at least one of backend, stream and routes is required"}},
+		{"unknown backend", func(c *config) { c.Backend = "api" }, []string{`backend: unknown backend "api"`}},
+		{"stream as backend", func(c *config) { c.Backend = "chat" }, []string{`backend: backend "chat" is not an HTTP backend`}},
+		{"http as stream", func(c *config) { c.Stream = "web" }, []string{`stream: backend "web" is not a stream backend`}},
+		{"stream as route", func(c *config) { c.Routes = []routeConfig{{Prefix: "/chat", Backend: "chat"}} }, []string{`routes[0].backend: backend "chat" is not an HTTP backend`}},
+		{"relative prefix", func(c *config) { c.Routes = []routeConfig{{Prefix: "api", Backend: "web"}} }, []string{"routes[0].prefix: must start with /"}},
+		{"bad scheme", func(c *config) { c.Backends["ftp"] = backendConfig{Target: "ftp://x"} }, []string{`backends.ftp.target: "ftp://x" is not a HTTP(S), WebSocket, TCP or UDP address`}},
+		{"bad target", func(c *config) { c.Backends["bad"] = backendConfig{Target: "http://[::1"} }, []string{"backends.bad.target: parse"}},
+		{"negative timeout", func(c *config) { c.Backends["web"] = backendConfig{Target: "http://x", Timeout: -1} }, []string{"backends.web.timeout: must not be negative"}},
+		{"password and secret", func(c *config) { c.Auth.Password, c.Auth.Secret = "a", "b" }, []string{"auth: password, secret and users are exclusive"}},
+		{"secret and users", func(c *config) { c.Auth.Secret, c.Auth.Users = "a", "users" }, []string{"auth: password, secret and users are exclusive"}},
+		{"negative limits", func(c *config) {
+			c.Auth.MaxTTL = -1
+			c.Limits.Validity = -1
+			c.Limits.NonceValidity = -1
+			c.Limits.HTTPTimeout = -1
+			c.Limits.MaxRequestSize = -1
+			c.Limits.CacheSize = -1
+			c.Limits.Rate.IP.Pokes.Rate = -1
+			c.Limits.Rate.Session.Executes.Burst = -1
+		}, []string{
+			"auth.max_ttl: must not be negative",
+			"limits.validity: must not be negative",
+			"limits.nonce_validity: must not be negative",
+			"limits.http_timeout: must not be negative",
+			"limits.max_request_size: must not be negative",
+			"limits.cache_size: must not be negative",
+			"limits.rate.ip.pokes: must not be negative",
+			"limits.rate.session.executes: must not be negative",
+		}},
+	} {
+		c := valid()
+		tc.modify(c)
+		err := c.validate()
+		if err == nil {
+			t.Errorf("%s: no error", tc.name)
+			continue
+		}
+		// every problem is reported, one per line
+		lines := strings.Split(err.Error(), "\n")
+		if len(lines) != len(tc.errs) {
+			t.Errorf("%s: got %q, want %q", tc.name, lines, tc.errs)
+			continue
+		}
+		for i, want := range tc.errs {
+			if !strings.HasPrefix(lines[i], want) {
+				t.Errorf("%s: got %q, want %q", tc.name, lines[i], want)
+			}
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	c := &config{
+		Backends: map[string]backendConfig{
+			"api":  {Target: "https://api.example/v1", Timeout: 5 * time.Second},
+			"web":  {Target: "http://127.0.0.1:8000"},
+			"dns":  {Target: "udp://127.0.0.1:53"},
+			"chat": {Target: "wss://chat.example/socket"},
+		},
+		Backend: "web",
+		Stream:  "dns",
+		Routes:  []routeConfig{{Host: "api.example", Prefix: "/v1", StripPrefix: true, Backend: "api"}},
+	}
+	c.Auth.Realm = "example.org"
+	c.Auth.Password = "secret"
+	c.Auth.Software = "test"
+	c.Auth.UsernamePrefix = "rpc:"
+	c.Auth.NonceSecret = "nonces"
+	c.Limits.Validity = time.Minute
+	c.Limits.NonceValidity = time.Hour
+	c.Limits.HTTPTimeout = 3 * time.Second
+	c.Limits.MaxRequestSize = 1000
+	c.Limits.CacheSize = 2000
+	c.Limits.Rate.IP.Pokes = turnx.RateLimit{Rate: 1, Burst: 2}
+	c.Limits.Rate.User.Executes = turnx.RateLimit{Rate: 3}
+	c.Limits.Rate.Session.Pokes = turnx.RateLimit{Rate: 4}
+	c.Logging.Output = "discard"
+
+	opts, err := c.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Realm != "example.org" || opts.Password != "secret" || opts.Software != "test" || opts.UsernamePrefix != "rpc:" ||
+		string(opts.NonceSecret) != "nonces" || opts.Validity != time.Minute || opts.NonceValidity != time.Hour ||
+		opts.MaxRequestSize != 1000 || opts.CacheSize != 2000 || opts.Auth != nil || opts.ErrorLog == nil {
+		t.Errorf("got %+v", opts)
+	}
+	want := turnx.RateLimits{
+		IPPokes:      turnx.RateLimit{Rate: 1, Burst: 2},
+		UserExecutes: turnx.RateLimit{Rate: 3},
+		SessionPokes: turnx.RateLimit{Rate: 4},
+	}
+	if opts.RateLimits != want {
+		t.Errorf("got rate limits %+v, want %+v", opts.RateLimits, want)
+	}
+	if _, ok := opts.StreamBackend.(*turnx.UDPBackend); !ok {
+		t.Errorf("got stream backend %T", opts.StreamBackend)
+	}
+
+	// the default backend becomes the last route
+	router, ok := opts.Backend.(*turnx.Router)
+	if !ok || len(router.Routes) != 2 || router.Default != nil {
+		t.Fatalf("got backend %#v", opts.Backend)
+	}
+	api, web := router.Routes[0], router.Routes[1]
+	if api.Name != "api" || api.Host != "api.example" || api.PathPrefix != "/v1" || !api.StripPrefix {
+		t.Errorf("got route %+v", api)
+	}
+	if b, ok := api.Backend.(*turnx.HTTPBackend); !ok || b.Target.Host != "api.example" || b.Client.Timeout != 5*time.Second {
+		t.Errorf("got api backend %#v", api.Backend)
+	}
+	if web.Name != "web" || web.Host != "" || web.PathPrefix != "" {
+		t.Errorf("got route %+v", web)
+	}
+	if b, ok := web.Backend.(*turnx.HTTPBackend); !ok || b.Client.Timeout != 3*time.Second {
+		t.Errorf("got web backend %#v", web.Backend)
+	}
+
+	// without routes the default backend is used as is
+	c.Routes = nil
+	if opts, err := c.options(); err != nil {
+		t.Fatal(err)
+	} else if _, ok := opts.Backend.(*turnx.HTTPBackend); !ok {
+		t.Errorf("got backend %T, want *turnx.HTTPBackend", opts.Backend)
+	}
+
+	// users are restricted to routes by name, so they get a router too
+	c.Auth.Password = ""
+	c.Auth.Users = writeFile(t, "users", "alice:secret backend=web\n")
+	opts, err = c.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := opts.Auth.(*turnx.UserFile); !ok {
+		t.Errorf("got auth %T, want *turnx.UserFile", opts.Auth)
+	}
+	if router, ok := opts.Backend.(*turnx.Router); !ok || len(router.Routes) != 1 || router.Routes[0].Name != "web" {
+		t.Errorf("got backend %#v", opts.Backend)
+	}
+
+	c.Auth.Users = ""
+	c.Auth.Secret = "rest"
+	c.Auth.MaxTTL = time.Hour
+	opts, err = c.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, ok := opts.Auth.(*turnx.RESTAuth); !ok || string(a.Secret) != "rest" || a.MaxTTL != time.Hour {
+		t.Errorf("got auth %#v", opts.Auth)
+	}
+
+	// files that can not be read fail the options
+	c.Auth.Secret = ""
+	c.Auth.Users = filepath.Join(t.TempDir(), "missing")
+	if _, err := c.options(); !os.IsNotExist(err) {
+		t.Errorf("missing user file: got %v", err)
+	}
+	c.Auth.Users = ""
+	c.Dictionaries = []string{filepath.Join(t.TempDir(), "missing")}
+	if _, err := c.options(); !os.IsNotExist(err) {
+		t.Errorf("missing dictionary: got %v", err)
+	}
+	c.Dictionaries = []string{writeFile(t, "dict", "GET POST")}
+	if opts, err := c.options(); err != nil || len(opts.Dictionaries) != 1 || string(opts.Dictionaries[0]) != "GET POST" {
+		t.Errorf("got dictionaries %q, %v", opts.Dictionaries, err)
+	}
+}
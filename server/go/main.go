@@ -1,226 +1,148 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"net"
+	"net/http"
 	"net/url"
+	"os"
 	"strings"
 
-	"github.com/pion/stun/v2"
+	"github.com/gyf304/webrtcsocket/server/turnx"
 )
 
-type funcSetter func(m *stun.Message) error
+// fileList is a repeatable flag collecting the contents of files.
+type fileList [][]byte
 
-func (f funcSetter) AddTo(m *stun.Message) error {
-	return f(m)
+func (f *fileList) String() string {
+	return fmt.Sprint(len(*f), " files")
 }
 
-var targetUrl *url.URL
-
-const (
-	password      = "turnrpc"
-	software      = "webrtcsocket"
-	realm         = "webrtcsocket.org"
-	turnrpcPrefix = "turnrpc:"
-)
-
-func randHex(n int) string {
-	b := make([]byte, n)
-	_, err := rand.Read(b)
+func (f *fileList) Set(name string) error {
+	b, err := os.ReadFile(name)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	return hex.EncodeToString(b)
+	*f = append(*f, b)
+	return nil
 }
 
-func genUnauthResponse(msg *stun.Message) *stun.Message {
-	return stun.MustBuild(
-		stun.NewTransactionIDSetter(msg.TransactionID),
-		stun.NewType(msg.Type.Method, stun.ClassErrorResponse),
-		stun.ErrorCodeAttribute{
-			Code:   stun.CodeUnauthorized,
-			Reason: []byte("Unauthorized"),
-		},
-		stun.NewNonce(randHex(24)),
-		stun.Realm([]byte(realm)),
-		stun.Software([]byte(software)),
-	)
+// routeList is a repeatable flag collecting routes of the form
+// [host][/prefix]=url.
+type routeList []turnx.Route
+
+func (r *routeList) String() string {
+	return fmt.Sprint(len(*r), " routes")
 }
 
-func checkAuth(msg *stun.Message) (username string, nonce []byte, err error) {
-	requiredAttrs := []stun.AttrType{
-		stun.AttrUsername,
-		stun.AttrNonce,
-		stun.AttrRealm,
-		stun.AttrMessageIntegrity,
+func (r *routeList) Set(value string) error {
+	pattern, target, ok := strings.Cut(value, "=")
+	if !ok {
+		return errors.New("route must be of the form [host][/prefix]=url")
 	}
-	for _, attr := range requiredAttrs {
-		if _, ok := msg.Attributes.Get(attr); !ok {
-			return "", nil, errors.New("No authentication factor " + attr.String())
-		}
-	}
-	usernameAttr, _ := msg.Attributes.Get(stun.AttrUsername)
-	username = string(usernameAttr.Value)
-	if !strings.HasPrefix(username, turnrpcPrefix) {
-		return "", nil, errors.New("Invalid username")
-	}
-	nonceAttr, _ := msg.Attributes.Get(stun.AttrNonce)
-	nonce = nonceAttr.Value
-	err = msg.Check(
-		stun.NewLongTermIntegrity(username, realm, password),
-	)
+	u, err := url.Parse(target)
 	if err != nil {
-		return "", nil, err
+		return err
 	}
-	return username, nonce, nil
-}
-
-func handleRequest(conn *net.UDPConn, addr *net.UDPAddr, msg *stun.Message) {
-	switch msg.Type.Class {
-	case stun.ClassRequest:
-		switch msg.Type.Method {
-		case stun.MethodBinding:
-			response := stun.MustBuild(
-				stun.NewTransactionIDSetter(msg.TransactionID),
-				stun.BindingSuccess,
-				stun.XORMappedAddress{
-					IP:   addr.IP,
-					Port: addr.Port,
-				},
-			)
-			conn.WriteToUDP(response.Raw, addr)
-		case stun.MethodAllocate:
-			username, _, err := checkAuth(msg)
-			if err != nil {
-				fmt.Println(err)
-				conn.WriteToUDP(genUnauthResponse(msg).Raw, addr)
-				return
-			}
-			req := username[len(turnrpcPrefix):]
-			payload, err := turnpoke(req)
-			if err != nil {
-				fmt.Println(err)
-				conn.WriteToUDP(genUnauthResponse(msg).Raw, addr)
-				return
-			}
-			payload_len := len(payload)
-			if len(payload) > 16 {
-				payload = payload[:16]
-				payload_len = 16
-			} else if len(payload) < 16 {
-				payload = append(payload, make([]byte, 16-len(payload))...)
-			}
-			ipBytes := append([]byte{0xfc}, payload[1:]...)
-			topByte := payload[0]
-			port := 0xc000 | (payload_len << 8) | int(topByte)
-			response := stun.MustBuild(
-				stun.NewTransactionIDSetter(msg.TransactionID),
-				stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse),
-				funcSetter(func(m *stun.Message) error {
-					tmp := stun.XORMappedAddress{
-						IP:   ipBytes,
-						Port: port,
-					}
-					return tmp.AddToAs(m, stun.AttrXORRelayedAddress)
-				}),
-				stun.RawAttribute{
-					Type:  stun.AttrLifetime,
-					Value: []byte{0xef, 0xff, 0xff, 0xff},
-				},
-				stun.XORMappedAddress{
-					IP:   addr.IP,
-					Port: addr.Port,
-				},
-				stun.Realm([]byte(realm)),
-				stun.Software([]byte(software)),
-				stun.NewLongTermIntegrity(username, realm, password),
-			)
-			conn.WriteToUDP(response.Raw, addr)
-		case stun.MethodRefresh:
-			username, _, err := checkAuth(msg)
-			if err != nil {
-				conn.WriteToUDP(genUnauthResponse(msg).Raw, addr)
-				return
-			}
-			lifetime, ok := msg.Attributes.Get(stun.AttrLifetime)
-			isDealloc := true
-			if ok {
-				for _, v := range lifetime.Value {
-					if v != 0 {
-						isDealloc = false
-						break
-					}
-				}
-			} else {
-				isDealloc = false
-			}
-			if isDealloc {
-				response := stun.MustBuild(
-					stun.NewTransactionIDSetter(msg.TransactionID),
-					stun.NewType(stun.MethodRefresh, stun.ClassSuccessResponse),
-					stun.RawAttribute{
-						Type:  stun.AttrLifetime,
-						Value: []byte{0x00, 0x00, 0x00, 0x00},
-					},
-					stun.NewLongTermIntegrity(username, realm, password),
-				)
-				conn.WriteToUDP(response.Raw, addr)
-			} else {
-				response := stun.MustBuild(
-					stun.NewTransactionIDSetter(msg.TransactionID),
-					stun.NewType(stun.MethodRefresh, stun.ClassErrorResponse),
-					stun.ErrorCodeAttribute{
-						Code:   stun.CodeInsufficientCapacity,
-						Reason: []byte("Insufficient Capacity"),
-					},
-					stun.NewLongTermIntegrity(username, realm, password),
-				)
-				conn.WriteToUDP(response.Raw, addr)
-			}
-		}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("route target must be a HTTP(S) address")
+	}
+	host, prefix, _ := strings.Cut(pattern, "/")
+	if prefix != "" {
+		prefix = "/" + prefix
 	}
+	*r = append(*r, turnx.Route{
+		Host:        host,
+		PathPrefix:  prefix,
+		StripPrefix: true,
+		Backend:     &turnx.HTTPBackend{Target: u},
+	})
+	return nil
 }
 
 func main() {
 	port := 0
 	flag.IntVar(&port, "port", port, "port to listen on")
 	target := ""
-	flag.StringVar(&target, "target", "", "target to connect to, must be a HTTP(S) address")
+	flag.StringVar(&target, "target", "", "target to connect to, a HTTP(S), WebSocket (ws, wss), tcp://host:port or udp://host:port address")
+	cacheSize := 0
+	flag.IntVar(&cacheSize, "cache", cacheSize, "size of the response cache in bytes, 0 disables it")
+	admin := ""
+	flag.StringVar(&admin, "admin", admin, "address to serve the admin API on, e.g. 127.0.0.1:8080 (default disabled)")
+	var dicts fileList
+	flag.Var(&dicts, "dict", "compression dictionary file, repeatable, preferred first (default built-in)")
+	var routes routeList
+	flag.Var(&routes, "route", "route [host][/prefix]=url, repeatable, tried in order before -target; the prefix is replaced by the path of url")
+	configPath := ""
+	flag.StringVar(&configPath, "config", "", "YAML config file, replacing all other flags")
 	flag.Parse()
 
-	u, err := url.Parse(target)
+	var opts turnx.Options
+	listen := []string{fmt.Sprintf(":%d", port)}
+	if configPath != "" {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name != "config" {
+				fmt.Fprintf(os.Stderr, "-%s cannot be combined with -config\n", f.Name)
+				os.Exit(2)
+			}
+		})
+		cfg, err := loadConfig(configPath)
+		if err == nil {
+			opts, err = cfg.options()
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		listen = cfg.Listen
+		admin = cfg.Admin
+	} else {
+		u, err := url.Parse(target)
+		if err != nil {
+			panic(err)
+		}
+		opts = turnx.Options{
+			Dictionaries: dicts,
+			CacheSize:    cacheSize,
+		}
+		switch {
+		case backendKind(u) != "":
+			opts.Backend, opts.StreamBackend = newBackend(u, 0)
+		case target != "":
+			panic("target must be a HTTP(S), WebSocket, TCP or UDP address")
+		case len(routes) == 0:
+			panic("either -target, -route or -config is required")
+		}
+		if len(routes) > 0 {
+			opts.Backend = &turnx.Router{Routes: routes, Default: opts.Backend}
+		}
+	}
+	srv, err := turnx.NewServer(opts)
 	if err != nil {
 		panic(err)
 	}
-	if u.Scheme != "http" && u.Scheme != "https" {
-		panic("target must be a HTTP(S) address")
-	}
-	targetUrl = u
+	defer srv.Close()
 
-	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
-	if err != nil {
-		panic(err)
+	if admin != "" {
+		go func() {
+			panic(http.ListenAndServe(admin, srv.AdminHandler()))
+		}()
 	}
-	defer conn.Close()
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
-	fmt.Println("Listening on", localAddr.Port)
 
-	buf := make([]byte, 65536)
-	for {
-		n, addr, err := conn.ReadFromUDP(buf[:])
+	errc := make(chan error, len(listen))
+	for _, addr := range listen {
+		conn, err := net.ListenPacket("udp", addr)
 		if err != nil {
 			panic(err)
 		}
-		msg := stun.Message{}
-		err = stun.Decode(buf[:n], &msg)
-		if err != nil {
-			continue
-		}
-
-		handleRequest(conn, addr, &msg)
+		defer conn.Close()
+		localAddr := conn.LocalAddr().(*net.UDPAddr)
+		fmt.Println("Listening on", localAddr.Port)
+		go func() {
+			errc <- srv.Serve(conn)
+		}()
 	}
+	panic(<-errc)
 }
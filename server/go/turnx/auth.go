@@ -0,0 +1,152 @@
+package turnx
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/stun/v2"
+)
+
+// Authenticator decides who may send requests.
+type Authenticator interface {
+	// Authenticate returns the identity a USERNAME claims, with the key or
+	// password its MESSAGE-INTEGRITY must verify with, or an error to
+	// reject it.
+	Authenticate(username string) (*Identity, error)
+}
+
+// Identity is what an Authenticator learns from a USERNAME. It must not be
+// modified once returned.
+type Identity struct {
+	// User is the authenticated user, empty for a shared password.
+	User string
+	// Password is the long-term password of the USERNAME.
+	Password string
+	// Key is the long-term key, MD5 of "<username>:<realm>:<password>".
+	// If set, it is used instead of Password.
+	Key []byte
+	// Request is the rest of the USERNAME, which starts with the username
+	// prefix. It is ignored when the request is sent in the TURNRPC
+	// attribute.
+	Request string
+	// Attrs holds attributes of the user, such as "backend", the comma
+	// separated names of the routes the user may use.
+	Attrs map[string]string
+}
+
+type userKey struct{}
+
+// UserFromContext returns the identity of the client a backend is serving.
+func UserFromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(userKey{}).(*Identity)
+	return id, ok
+}
+
+func withUser(ctx context.Context, id *Identity) context.Context {
+	if id == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, userKey{}, id)
+}
+
+// integrity returns the MESSAGE-INTEGRITY of messages sent as username.
+func (id *Identity) integrity(username, realm string) stun.MessageIntegrity {
+	if id.Key != nil {
+		return stun.MessageIntegrity(id.Key)
+	}
+	return stun.NewLongTermIntegrity(username, realm, id.Password)
+}
+
+// restricted reports whether the "backend" attribute limits the routes the
+// user may use.
+func (id *Identity) restricted() bool {
+	_, ok := id.Attrs["backend"]
+	return ok
+}
+
+// allows reports whether the user may use the route name.
+func (id *Identity) allows(name string) bool {
+	backends, ok := id.Attrs["backend"]
+	if !ok {
+		return true
+	}
+	for _, b := range strings.Split(backends, ",") {
+		if b == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SharedPassword authenticates every USERNAME with the same password.
+type SharedPassword string
+
+func (p SharedPassword) Authenticate(username string) (*Identity, error) {
+	return &Identity{Password: string(p), Request: username}, nil
+}
+
+// RESTAuth authenticates the time-limited credentials of the TURN REST API:
+// the USERNAME is "<expiry>:<user>:<request>", where expiry is a Unix
+// timestamp, and the password is the base64 HMAC-SHA1 of "<expiry>:<user>"
+// under Secret. RESTCredentials mints them.
+type RESTAuth struct {
+	Secret []byte
+	// MaxTTL rejects credentials expiring further in the future, as
+	// minted with a leaked secret would. Zero allows any.
+	MaxTTL time.Duration
+
+	now func() time.Time // time.Now if nil, tests replace it
+}
+
+func (a *RESTAuth) Authenticate(username string) (*Identity, error) {
+	expiryStr, rest, _ := strings.Cut(username, ":")
+	user, req, ok := strings.Cut(rest, ":")
+	if !ok {
+		return nil, errors.New("Invalid username")
+	}
+	expiry, err := strconv.ParseInt(expiryStr, 10, 64)
+	if err != nil {
+		return nil, errors.New("Invalid username")
+	}
+	now := time.Now
+	if a.now != nil {
+		now = a.now
+	}
+	ttl := time.Unix(expiry, 0).Sub(now())
+	if ttl <= 0 {
+		return nil, errors.New("Credential expired")
+	}
+	if a.MaxTTL > 0 && ttl > a.MaxTTL {
+		return nil, errors.New("Credential expires too late")
+	}
+	return &Identity{
+		User:     user,
+		Password: restPassword(a.Secret, expiryStr+":"+user),
+		Request:  req,
+	}, nil
+}
+
+func restPassword(secret []byte, username string) string {
+	mac := hmac.New(sha1.New, secret)
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// RESTCredentials mints TURN REST API credentials for user, which must not
+// contain a colon, valid for ttl. They go in Client.Username and
+// Client.Password.
+func RESTCredentials(secret []byte, user string, ttl time.Duration) (username, password string) {
+	return restCredentials(secret, user, time.Now().Add(ttl))
+}
+
+// restCredentials mints credentials for user expiring at expiry.
+func restCredentials(secret []byte, user string, expiry time.Time) (username, password string) {
+	username = strconv.FormatInt(expiry.Unix(), 10) + ":" + user
+	return username, restPassword(secret, username)
+}
@@ -0,0 +1,55 @@
+package turnx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRESTAuth(t *testing.T) {
+	secret := []byte("secret")
+	clock := newTestClock()
+	addr := serve(t, newTestServerWith(t, Options{
+		Backend: &HandlerBackend{Handler: echoHandler},
+		Auth:    &RESTAuth{Secret: secret, MaxTTL: time.Hour, now: clock.Now},
+		now:     clock.Now,
+	}))
+	ctx := context.Background()
+	user := strings.Repeat("u", 64)
+	username, password := restCredentials(secret, user, clock.Now().Add(time.Minute))
+	client := &Client{Addr: addr, Username: username, Password: password}
+	body := bytes.Repeat([]byte("0123456789"), 100)
+	req := append([]byte("POST /rest HTTP/1.1\r\nHost: localhost\r\nContent-Length: 1000\r\n\r\n"), body...)
+	resp, err := client.Call(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(resp, body) {
+		t.Errorf("got %q", resp)
+	}
+
+	expired, expiredPassword := restCredentials(secret, user, clock.Now().Add(-time.Minute))
+	late, latePassword := restCredentials(secret, user, clock.Now().Add(2*time.Hour))
+	for _, tc := range []struct{ name, username, password string }{
+		{"expired", expired, expiredPassword},
+		{"too late", late, latePassword},
+		{"forged", username, "forged"},
+		{"other user", strings.Replace(username, user, "admin", 1), password},
+		{"no credentials", "", ""},
+	} {
+		client := &Client{Addr: addr, Username: tc.username, Password: tc.password, Timeout: time.Second}
+		if _, err := client.Poke(ctx, "v:"); !errors.Is(err, ErrRejected) {
+			t.Errorf("%s: got %v, want ErrRejected", tc.name, err)
+		}
+	}
+
+	// the credentials of the call expire with the clock
+	clock.Advance(time.Minute)
+	client.Timeout = time.Second
+	if _, err := client.Poke(ctx, "v:"); !errors.Is(err, ErrRejected) {
+		t.Errorf("after expiry: got %v, want ErrRejected", err)
+	}
+}
@@ -0,0 +1,174 @@
+package turnx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Backend executes the decompressed payload of an e: request and returns
+// the raw response, which the Server compresses and serves through r:.
+type Backend interface {
+	Execute(ctx context.Context, req []byte) ([]byte, error)
+}
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// HTTPBackend forwards serialized HTTP requests to a remote HTTP(S) server.
+type HTTPBackend struct {
+	// Target is the HTTP(S) address requests are sent to. The path and
+	// query of each request are joined under the path and query of Target,
+	// as by httputil.NewSingleHostReverseProxy.
+	Target *url.URL
+	// Client sends the requests. If nil, a client with a 10 second
+	// timeout is used.
+	Client *http.Client
+}
+
+func (b *HTTPBackend) Execute(ctx context.Context, req []byte) ([]byte, error) {
+	httpReq, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(req)))
+	if err != nil {
+		return errorResponse(http.StatusBadRequest), nil
+	}
+
+	httpReq.Header.Del("Host")
+	httpReq.Host = b.Target.Host
+	httpReq.URL.Host = b.Target.Host
+	httpReq.URL.Scheme = b.Target.Scheme
+	httpReq.URL.Path, httpReq.URL.RawPath = joinURLPath(b.Target, httpReq.URL)
+	if b.Target.RawQuery == "" || httpReq.URL.RawQuery == "" {
+		httpReq.URL.RawQuery = b.Target.RawQuery + httpReq.URL.RawQuery
+	} else {
+		httpReq.URL.RawQuery = b.Target.RawQuery + "&" + httpReq.URL.RawQuery
+	}
+	httpReq.RequestURI = ""
+
+	client := b.Client
+	if client == nil {
+		client = defaultClient
+	}
+	httpResp, err := client.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return errorResponse(http.StatusGatewayTimeout), nil
+		}
+		return errorResponse(http.StatusBadGateway), nil
+	}
+	defer httpResp.Body.Close()
+	wr := &bytes.Buffer{}
+	err = httpResp.Write(wr)
+	if err != nil {
+		return nil, err
+	}
+	return wr.Bytes(), nil
+}
+
+// joinURLPath joins the path of u under the path of base, keeping the
+// escaping of both.
+func joinURLPath(base, u *url.URL) (path, rawpath string) {
+	if base.RawPath == "" && u.RawPath == "" {
+		return singleJoiningSlash(base.Path, u.Path), ""
+	}
+	// Same as singleJoiningSlash, but uses EscapedPath to determine
+	// whether a slash should be added
+	bpath := base.EscapedPath()
+	upath := u.EscapedPath()
+	bslash := strings.HasSuffix(bpath, "/")
+	uslash := strings.HasPrefix(upath, "/")
+	switch {
+	case bslash && uslash:
+		return base.Path + u.Path[1:], bpath + upath[1:]
+	case !bslash && !uslash:
+		return base.Path + "/" + u.Path, bpath + "/" + upath
+	}
+	return base.Path + u.Path, bpath + upath
+}
+
+func singleJoiningSlash(a, b string) string {
+	bslash := strings.HasPrefix(b, "/")
+	aslash := strings.HasSuffix(a, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// HandlerBackend serves requests with an in-process http.Handler, without a
+// loopback HTTP hop.
+type HandlerBackend struct {
+	Handler http.Handler
+}
+
+func (b *HandlerBackend) Execute(ctx context.Context, req []byte) ([]byte, error) {
+	httpReq, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(req)))
+	if err != nil {
+		return errorResponse(http.StatusBadRequest), nil
+	}
+	httpReq = httpReq.WithContext(ctx)
+
+	w := &responseBuffer{header: make(http.Header)}
+	b.Handler.ServeHTTP(w, httpReq)
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	httpResp := http.Response{
+		StatusCode:    w.status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		Body:          io.NopCloser(&w.body),
+		ContentLength: int64(w.body.Len()),
+		Request:       httpReq,
+	}
+	wr := &bytes.Buffer{}
+	err = httpResp.Write(wr)
+	if err != nil {
+		return nil, err
+	}
+	return wr.Bytes(), nil
+}
+
+// responseBuffer is the http.ResponseWriter given to a HandlerBackend's
+// handler.
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *responseBuffer) Header() http.Header {
+	return w.header
+}
+
+func (w *responseBuffer) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *responseBuffer) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+func errorResponse(status int) []byte {
+	wr := &bytes.Buffer{}
+	errResp := http.Response{
+		StatusCode: status,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}
+	errResp.Write(wr)
+	return wr.Bytes()
+}
@@ -0,0 +1,390 @@
+package turnx
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"hash/adler32"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// responseCache is a shared HTTP cache in the sense of RFC 9111 in front of
+// the backend. Responses are stored compressed, along with the codec and
+// dictionary they were compressed with, so a hit costs neither a backend call
+// nor compression. For the same reason stored responses are served as they
+// were received, without an updated Age header.
+type responseCache struct {
+	maxSize int
+	group   singleflight.Group
+
+	mu      sync.Mutex
+	size    int
+	entries map[string][]*cacheEntry // by method, host and request URI
+	lru     *list.List               // of *cacheEntry, most recently used first
+}
+
+// cacheEntry is a stored response. Apart from elem, it is not modified once
+// stored.
+type cacheEntry struct {
+	key    string
+	codec  codec
+	dictID uint32
+	// vary holds the request headers named by the Vary of the response.
+	vary   http.Header
+	comped []byte
+
+	date         time.Time // when the response was generated
+	lifetime     time.Duration
+	noCache      bool
+	etag         string
+	lastModified string
+	elem         *list.Element
+}
+
+// cacheableStatus lists the status codes that are heuristically cacheable,
+// RFC 9110 section 15.1. Others are not stored.
+var cacheableStatus = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+func newResponseCache(maxSize int) *responseCache {
+	return &responseCache{
+		maxSize: maxSize,
+		entries: make(map[string][]*cacheEntry),
+		lru:     list.New(),
+	}
+}
+
+// dictionaryID identifies d for cache keys. Unlike every dictionary, no
+// dictionary at all gets 0.
+func dictionaryID(d []byte) uint32 {
+	if d == nil {
+		return 0
+	}
+	return adler32.Checksum(d)
+}
+
+// cacheControl parses the Cache-Control directives of h. Names are lower
+// case and quoted values are unquoted.
+func cacheControl(h http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, line := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(line, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if name == "" {
+				continue
+			}
+			cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+	return cc
+}
+
+// seconds parses a delta-seconds value.
+func seconds(v string) (time.Duration, bool) {
+	n, err := strconv.ParseUint(v, 10, 31)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// freshness returns the freshness lifetime a response explicitly declares,
+// RFC 9111 section 4.2.1.
+func freshness(h http.Header, cc map[string]string) (time.Duration, bool) {
+	if d, ok := seconds(cc["s-maxage"]); ok {
+		return d, true
+	}
+	if d, ok := seconds(cc["max-age"]); ok {
+		return d, true
+	}
+	if v := h.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return 0, true // invalid dates are in the past
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		return max(expires.Sub(date), 0), true
+	}
+	return 0, false
+}
+
+// respond answers req through the cache, or directly from the backend if the
+// request can not be answered from a cache.
+func (cache *responseCache) respond(ctx context.Context, s *Server, c codec, d []byte, req []byte) ([]byte, error) {
+	r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(req)))
+	if err != nil {
+		_, comped, err := s.fetch(ctx, c, d, req)
+		return comped, err
+	}
+	target := r.Host + r.RequestURI
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions, http.MethodTrace:
+		_, comped, err := s.fetch(ctx, c, d, req)
+		return comped, err
+	default:
+		// unsafe methods invalidate what is stored for their target,
+		// RFC 9111 section 4.4
+		resp, comped, err := s.fetch(ctx, c, d, req)
+		if err == nil {
+			hr, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(resp)), r)
+			if err == nil && hr.StatusCode < 400 {
+				cache.invalidate(target)
+			}
+		}
+		return comped, err
+	}
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Range") != "" ||
+		r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		_, comped, err := s.fetch(ctx, c, d, req)
+		return comped, err
+	}
+	if _, ok := cacheControl(r.Header)["no-store"]; ok {
+		_, comped, err := s.fetch(ctx, c, d, req)
+		return comped, err
+	}
+	// backends may answer each user differently, through UserFromContext
+	if user, ok := UserFromContext(ctx); ok && user.User != "" {
+		_, comped, err := s.fetch(ctx, c, d, req)
+		return comped, err
+	}
+
+	// identical requests in flight share one backend call. It is detached
+	// from the caller that starts it, whose deadline or cancellation must
+	// not fail the others, and may run as long as any request may wait;
+	// each caller waits only as long as its own ctx allows.
+	dictID := dictionaryID(d)
+	flight := fmt.Sprintf("%d:%08x:%s", c, dictID, req)
+	ch := cache.group.DoChan(flight, func() (v any, err error) {
+		// DoChan would rethrow a panic where nothing can recover it
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("Cache panic: %v", r)
+			}
+		}()
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.validity)
+		defer cancel()
+		defer context.AfterFunc(s.ctx, cancel)()
+		return cache.lookup(ctx, s, c, d, dictID, r, req)
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.([]byte), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (cache *responseCache) lookup(ctx context.Context, s *Server, c codec, d []byte, dictID uint32, r *http.Request, req []byte) ([]byte, error) {
+	key := r.Method + " " + r.Host + r.RequestURI
+	reqCC := cacheControl(r.Header)
+	now := time.Now()
+	e := cache.get(key, c, dictID, r.Header)
+	if e != nil {
+		_, noCache := reqCC["no-cache"]
+		maxAge, ok := seconds(reqCC["max-age"])
+		age := now.Sub(e.date)
+		if !e.noCache && !noCache && age < e.lifetime && (!ok || age <= maxAge) {
+			return e.comped, nil
+		}
+		if e.etag == "" && e.lastModified == "" {
+			e = nil
+		}
+	}
+	if e != nil {
+		req = conditional(req, e)
+	}
+
+	resp, comped, err := s.fetch(ctx, c, d, req)
+	if err != nil {
+		return nil, err
+	}
+	hr, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(resp)), r)
+	if err != nil {
+		return comped, nil
+	}
+	if e != nil && hr.StatusCode == http.StatusNotModified {
+		cache.refresh(e, hr.Header, now)
+		return e.comped, nil
+	}
+	cache.store(key, c, dictID, r, hr, comped, now)
+	return comped, nil
+}
+
+// conditional adds validators of e to the raw request req.
+func conditional(req []byte, e *cacheEntry) []byte {
+	var h bytes.Buffer
+	if e.etag != "" {
+		fmt.Fprintf(&h, "If-None-Match: %s\r\n", e.etag)
+	}
+	if e.lastModified != "" {
+		fmt.Fprintf(&h, "If-Modified-Since: %s\r\n", e.lastModified)
+	}
+	i := bytes.IndexByte(req, '\n') + 1
+	return append(append(append([]byte{}, req[:i]...), h.Bytes()...), req[i:]...)
+}
+
+// varyHeaders returns the request headers named by the Vary of the response,
+// and false for Vary: *.
+func varyHeaders(resp http.Header, req http.Header) (http.Header, bool) {
+	vary := http.Header{}
+	for _, line := range resp.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" {
+				vary[http.CanonicalHeaderKey(name)] = req.Values(name)
+			}
+		}
+	}
+	return vary, true
+}
+
+func (e *cacheEntry) matches(c codec, dictID uint32, h http.Header) bool {
+	if e.codec != c || e.dictID != dictID {
+		return false
+	}
+	for name, values := range e.vary {
+		if strings.Join(values, ",") != strings.Join(h.Values(name), ",") {
+			return false
+		}
+	}
+	return true
+}
+
+func (cache *responseCache) get(key string, c codec, dictID uint32, h http.Header) *cacheEntry {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for _, e := range cache.entries[key] {
+		if e.matches(c, dictID, h) {
+			cache.lru.MoveToFront(e.elem)
+			return e
+		}
+	}
+	return nil
+}
+
+// setFreshness updates the freshness of e from response headers h received
+// at now.
+func (e *cacheEntry) setFreshness(h http.Header, cc map[string]string, now time.Time) {
+	e.date = now
+	if age, ok := seconds(h.Get("Age")); ok {
+		e.date = now.Add(-age)
+	}
+	if lifetime, ok := freshness(h, cc); ok {
+		e.lifetime = lifetime
+	}
+	_, e.noCache = cc["no-cache"]
+}
+
+// refresh updates e from a 304 Not Modified received at now. Entries are
+// replaced rather than modified, as lookup reads them without the lock.
+func (cache *responseCache) refresh(e *cacheEntry, h http.Header, now time.Time) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	entries := cache.entries[e.key]
+	for i, other := range entries {
+		if other == e {
+			updated := *e
+			updated.setFreshness(h, cacheControl(h), now)
+			updated.elem.Value = &updated
+			entries[i] = &updated
+			return
+		}
+	}
+}
+
+func (cache *responseCache) store(key string, c codec, dictID uint32, r *http.Request, hr *http.Response, comped []byte, now time.Time) {
+	cc := cacheControl(hr.Header)
+	if !cacheableStatus[hr.StatusCode] || len(comped) > cache.maxSize {
+		return
+	}
+	for _, name := range []string{"no-store", "private"} {
+		if _, ok := cc[name]; ok {
+			return
+		}
+	}
+	// Set-Cookie is personal even where the response is not marked private
+	if hr.Header.Get("Set-Cookie") != "" {
+		return
+	}
+	vary, ok := varyHeaders(hr.Header, r.Header)
+	if !ok {
+		return
+	}
+	e := &cacheEntry{
+		key:          key,
+		codec:        c,
+		dictID:       dictID,
+		vary:         vary,
+		comped:       comped,
+		etag:         hr.Header.Get("ETag"),
+		lastModified: hr.Header.Get("Last-Modified"),
+	}
+	e.setFreshness(hr.Header, cc, now)
+	if e.lifetime == 0 && e.etag == "" && e.lastModified == "" {
+		return
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for _, old := range cache.entries[key] {
+		if old.matches(c, dictID, r.Header) {
+			cache.remove(old)
+			break
+		}
+	}
+	e.elem = cache.lru.PushFront(e)
+	cache.entries[key] = append(cache.entries[key], e)
+	cache.size += len(comped)
+	for cache.size > cache.maxSize {
+		cache.remove(cache.lru.Back().Value.(*cacheEntry))
+	}
+}
+
+// invalidate removes the stored responses for target.
+func (cache *responseCache) invalidate(target string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		for _, e := range cache.entries[method+" "+target] {
+			cache.remove(e)
+		}
+	}
+}
+
+// remove drops e. The lock must be held.
+func (cache *responseCache) remove(e *cacheEntry) {
+	entries := cache.entries[e.key]
+	for i, other := range entries {
+		if other == e {
+			entries = append(entries[:i:i], entries[i+1:]...)
+			break
+		}
+	}
+	if len(entries) == 0 {
+		delete(cache.entries, e.key)
+	} else {
+		cache.entries[e.key] = entries
+	}
+	cache.lru.Remove(e.elem)
+	cache.size -= len(e.comped)
+}
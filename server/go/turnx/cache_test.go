@@ -0,0 +1,261 @@
+package turnx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	var calls atomic.Int32
+	etag := `"v1"`
+	release := make(chan struct{})
+	srv := newTestServerWith(t, Options{
+		Backend: &HandlerBackend{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			switch r.URL.Path {
+			case "/static":
+				<-release
+				w.Header().Set("Cache-Control", "max-age=60")
+				w.Header().Set("Vary", "Accept-Language")
+			case "/etag":
+				w.Header().Set("Cache-Control", "no-cache")
+				w.Header().Set("ETag", etag)
+				if r.Header.Get("If-None-Match") == etag {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+			case "/private":
+				w.Header().Set("Cache-Control", "private, max-age=60")
+			}
+			fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, r.Header.Get("Accept-Language"))
+		})},
+		CacheSize: 1 << 20,
+	})
+	client := &Client{Addr: serve(t, srv)}
+	ctx := context.Background()
+	get := func(method, path, lang string) string {
+		t.Helper()
+		req := fmt.Sprintf("%s %s HTTP/1.1\r\nHost: localhost\r\nAccept-Language: %s\r\nContent-Length: 0\r\n\r\n", method, path, lang)
+		resp, err := client.Call(ctx, []byte(req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpResp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(resp)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(httpResp.Body)
+		return string(body)
+	}
+	expectCalls := func(want int32) {
+		t.Helper()
+		if n := calls.Swap(0); n != want {
+			t.Errorf("backend called %d times, want %d", n, want)
+		}
+	}
+
+	// concurrent identical requests share one backend call, held until
+	// all of them execute
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if body := get("GET", "/static", "en"); body != "GET /static en" {
+				t.Errorf("got %q", body)
+			}
+		}()
+	}
+	for pending(srv) < 4 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	expectCalls(1)
+	get("GET", "/static", "en")
+	expectCalls(0)
+	if body := get("GET", "/static", "fr"); body != "GET /static fr" {
+		t.Errorf("Vary: got %q", body)
+	}
+	expectCalls(1)
+	get("POST", "/static", "en")
+	get("GET", "/static", "en")
+	expectCalls(2)
+
+	for range 2 {
+		if body := get("GET", "/etag", "en"); body != "GET /etag en" {
+			t.Errorf("revalidated: got %q", body)
+		}
+	}
+	expectCalls(2)
+	for range 2 {
+		get("GET", "/private", "en")
+	}
+	expectCalls(2)
+}
+
+// pending counts the executed requests of s that have no outcome yet.
+func pending(s *Server) int {
+	s.longReqLock.Lock()
+	defer s.longReqLock.Unlock()
+	n := 0
+	for _, status := range s.longStatuses {
+		if status == statusPending {
+			n++
+		}
+	}
+	return n
+}
+
+func TestCacheDetached(t *testing.T) {
+	var calls atomic.Int32
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	s := newTestServerWith(t, Options{
+		Backend: &HandlerBackend{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) == 1 {
+				close(entered)
+			}
+			select {
+			case <-release:
+			case <-r.Context().Done():
+				t.Error("shared fetch canceled with its first caller")
+			}
+			w.Header().Set("Cache-Control", "max-age=60")
+			io.WriteString(w, "shared")
+		})},
+		CacheSize: 1 << 20,
+	})
+	req := []byte("GET /shared HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := s.respond(ctx, codecZlib, nil, req)
+		errc <- err
+	}()
+	<-entered
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("canceled caller: got %v", err)
+	}
+
+	done := make(chan []byte, 1)
+	go func() {
+		comped, err := s.respond(context.Background(), codecZlib, nil, req)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- comped
+	}()
+	close(release)
+	resp, err := codecZlib.decompress(<-done, nil, maxDecompressedSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(resp, []byte("shared")) {
+		t.Errorf("got %q", resp)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("backend called %d times, want 1", n)
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	h := http.Header{"Cache-Control": {`Max-Age=60, no-cache`, ` private="Set-Cookie",,`}}
+	got := cacheControl(h)
+	want := map[string]string{"max-age": "60", "no-cache": "", "private": "Set-Cookie"}
+	if !maps.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFreshness(t *testing.T) {
+	date := "Mon, 02 Jan 2006 15:04:05 GMT"
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+		ok     bool
+	}{
+		{"none", http.Header{}, 0, false},
+		{"max-age", http.Header{"Cache-Control": {"max-age=60"}}, time.Minute, true},
+		{"s-maxage wins", http.Header{"Cache-Control": {"max-age=60, s-maxage=10"}}, 10 * time.Second, true},
+		{"invalid max-age", http.Header{"Cache-Control": {"max-age=-1"}}, 0, false},
+		{"expires", http.Header{"Date": {date}, "Expires": {"Mon, 02 Jan 2006 15:05:05 GMT"}}, time.Minute, true},
+		{"expired", http.Header{"Date": {date}, "Expires": {"Mon, 02 Jan 2006 15:00:00 GMT"}}, 0, true},
+		{"invalid expires", http.Header{"Date": {date}, "Expires": {"0"}}, 0, true},
+		{"max-age over expires", http.Header{"Cache-Control": {"max-age=5"}, "Date": {date}, "Expires": {"Mon, 02 Jan 2006 15:05:05 GMT"}}, 5 * time.Second, true},
+	} {
+		got, ok := freshness(tc.header, cacheControl(tc.header))
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("%s: got %v, %v, want %v, %v", tc.name, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestVaryHeaders(t *testing.T) {
+	req := http.Header{"Accept-Language": {"en"}, "Accept": {"text/html"}}
+	vary, ok := varyHeaders(http.Header{"Vary": {"accept-language, Origin", ""}}, req)
+	want := http.Header{"Accept-Language": {"en"}, "Origin": nil}
+	if !ok || !reflect.DeepEqual(vary, want) {
+		t.Errorf("got %v, %v, want %v", vary, ok, want)
+	}
+	if _, ok := varyHeaders(http.Header{"Vary": {"Accept, *"}}, req); ok {
+		t.Error("Vary: * is cacheable")
+	}
+
+	e := &cacheEntry{codec: codecZlib, vary: want}
+	if !e.matches(codecZlib, 0, http.Header{"Accept-Language": {"en"}, "Accept": {"*/*"}}) {
+		t.Error("unvaried header prevents a match")
+	}
+	if e.matches(codecZlib, 0, http.Header{"Accept-Language": {"fr"}}) {
+		t.Error("varied header matches")
+	}
+	if e.matches(codecZlib, 0, http.Header{"Accept-Language": {"en"}, "Origin": {"https://a.example"}}) {
+		t.Error("header absent from the stored request matches")
+	}
+	if e.matches(codecZstd, 0, req) {
+		t.Error("other codec matches")
+	}
+}
+
+func TestCacheUsers(t *testing.T) {
+	var calls atomic.Int32
+	secret := []byte("secret")
+	addr := serve(t, newTestServerWith(t, Options{
+		Backend: &HandlerBackend{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			user, _ := UserFromContext(r.Context())
+			w.Header().Set("Cache-Control", "max-age=60")
+			fmt.Fprintf(w, "hello %s", user.User)
+		})},
+		Auth:      &RESTAuth{Secret: secret},
+		CacheSize: 1 << 20,
+	}))
+	ctx := context.Background()
+	for _, user := range []string{"alice", "bob", "alice"} {
+		username, password := RESTCredentials(secret, user, time.Minute)
+		client := &Client{Addr: addr, Username: username, Password: password}
+		resp, err := client.Call(ctx, []byte("GET /me HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "hello " + user; !bytes.HasSuffix(resp, []byte(want)) {
+			t.Errorf("got %q, want %q", resp, want)
+		}
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("backend called %d times, want 3", n)
+	}
+}
@@ -0,0 +1,94 @@
+package turnx
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// protocolVersion is bumped whenever the wire format changes in a way
+// clients have to know about.
+const protocolVersion = 6
+
+// checksumVersion is the first protocol version with m: and the checksums
+// of e:, which clients only use with servers at least this new.
+const checksumVersion = 3
+
+// Capabilities describes what a server supports. It is returned by the v:
+// method as a compact record that fits a single reply:
+//
+//	byte  0     protocol version
+//	bytes 1-2   max chunk size accepted by c:
+//	byte  3     supported codecs, bit i set for codecNames[i]
+//	bytes 4-7   Adler-32 id of the preferred dictionary
+//	bytes 8-9   session validity in seconds
+//	byte  10    flags, bit 0 set if stream sessions carry datagrams
+//
+// Servers before version 6 send no flags.
+type Capabilities struct {
+	Version      int
+	MaxChunkSize int
+	Codecs       []string
+	DictID       uint32
+	Validity     time.Duration
+	// Datagrams is set if the content of every w: is sent to the stream
+	// backend as one datagram, so writes must not be split across chunks.
+	Datagrams bool
+}
+
+const capabilitiesSize = 11
+
+// flagDatagrams is the bit of Capabilities.Datagrams in the flags byte.
+const flagDatagrams = 1 << 0
+
+func (c *Capabilities) marshal() []byte {
+	b := make([]byte, capabilitiesSize)
+	b[0] = byte(c.Version)
+	binary.BigEndian.PutUint16(b[1:], uint16(c.MaxChunkSize))
+	for i, name := range codecNames {
+		for _, codec := range c.Codecs {
+			if codec == name {
+				b[3] |= 1 << i
+			}
+		}
+	}
+	binary.BigEndian.PutUint32(b[4:], c.DictID)
+	binary.BigEndian.PutUint16(b[8:], uint16(min(c.Validity/time.Second, 0xffff)))
+	if c.Datagrams {
+		b[10] |= flagDatagrams
+	}
+	return b
+}
+
+func parseCapabilities(b []byte) (*Capabilities, error) {
+	if len(b) < capabilitiesSize-1 {
+		return nil, errors.New("turnx: invalid capability record")
+	}
+	c := &Capabilities{
+		Version:      int(b[0]),
+		MaxChunkSize: int(binary.BigEndian.Uint16(b[1:])),
+		DictID:       binary.BigEndian.Uint32(b[4:]),
+		Validity:     time.Duration(binary.BigEndian.Uint16(b[8:])) * time.Second,
+	}
+	if len(b) >= capabilitiesSize {
+		c.Datagrams = b[10]&flagDatagrams != 0
+	}
+	for i, name := range codecNames {
+		if b[3]&(1<<i) != 0 {
+			c.Codecs = append(c.Codecs, name)
+		}
+	}
+	return c, nil
+}
+
+func (s *Server) capabilities() *Capabilities {
+	_, datagrams := s.streamBackend.(datagramBackend)
+	return &Capabilities{
+		Version:      protocolVersion,
+		MaxChunkSize: maxChunkSize,
+		Codecs:       codecNames,
+		DictID:       s.dictID,
+		Validity:     s.validity,
+		Datagrams:    datagrams,
+	}
+}
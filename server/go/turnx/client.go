@@ -0,0 +1,557 @@
+package turnx
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/stun/v2"
+)
+
+const (
+	reqPartSize = 256
+	batchSize   = 32
+	// maxUsernameChunk is the largest chunk whose c: still fits the 513
+	// byte limit of a STUN USERNAME.
+	maxUsernameChunk = 336
+
+	defaultPokeTimeout = 5 * time.Second
+	initialRTO         = 250 * time.Millisecond
+	// maxUploadRounds bounds how often missing request parts are re-sent.
+	maxUploadRounds  = 3
+	initialPollDelay = 50 * time.Millisecond
+	maxPollDelay     = time.Second
+)
+
+// Client calls a turnx server directly over STUN, speaking the same s:, c:,
+// m:, e:, p:, q: and r: protocol as the browser client in client/src/turnx.ts.
+// A Client is safe for concurrent use.
+type Client struct {
+	// Addr is the host:port of the turnx server.
+	Addr string
+	// Username is the "<expiry>:<user>" of TURN REST API credentials, as
+	// minted by RESTCredentials, or with Attribute the user of a UserFile.
+	// Empty for a shared password.
+	Username string
+	// Password is the long-term credential. Defaults to "turnrpc".
+	Password string
+	// UsernamePrefix must match the server's. Defaults to "turnrpc:".
+	UsernamePrefix string
+	// Attribute sends requests in the TURNRPC attribute instead of the
+	// USERNAME, which is then Username alone, as a UserFile requires.
+	Attribute bool
+	// Timeout bounds each individual poke. Defaults to 5 seconds.
+	Timeout time.Duration
+	// Dictionary compresses requests and decompresses responses.
+	// Defaults to DefaultDictionary; an empty, non-nil slice compresses
+	// without one. The server must accept it.
+	Dictionary []byte
+	// Codec is the compression codec, "zlib" or "zstd". Defaults to zlib,
+	// which every server supports.
+	Codec string
+
+	mu    sync.Mutex
+	realm string
+	nonce string
+	caps  *Capabilities
+}
+
+var (
+	// ErrRejected is returned when the server refuses a poke.
+	ErrRejected = errors.New("turnx: request rejected")
+	// ErrRateLimited is returned when the server still limits a poke once
+	// its timeout is over.
+	ErrRateLimited = errors.New("turnx: rate limited")
+	// ErrNoMessage is returned by Receive when the mailbox is empty.
+	ErrNoMessage = errors.New("turnx: no message")
+	// ErrDatagramTooLong is returned by Tunnel.Write when the server sends
+	// every w: as a datagram and the write does not fit a single chunk.
+	ErrDatagramTooLong = errors.New("turnx: datagram too long")
+)
+
+func (c *Client) password() string {
+	if c.Password == "" {
+		return defaultPassword
+	}
+	return c.Password
+}
+
+func (c *Client) prefix() string {
+	if c.UsernamePrefix == "" {
+		return defaultPrefix
+	}
+	return c.UsernamePrefix
+}
+
+// maxChunk is maxUsernameChunk shrunk by what the credentials and a longer
+// prefix add to the USERNAME, in whole base64 quanta. Requests sent in the
+// TURNRPC attribute are not bound by the USERNAME.
+func (c *Client) maxChunk() int {
+	if c.Attribute {
+		return maxChunkSize
+	}
+	extra := len(c.prefix()) - len(defaultPrefix)
+	if c.Username != "" {
+		extra += len(c.Username) + 1
+	}
+	if extra <= 0 {
+		return maxUsernameChunk
+	}
+	return max(maxUsernameChunk-(extra+3)/4*3, 3)
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return defaultPokeTimeout
+	}
+	return c.Timeout
+}
+
+func (c *Client) challenge() (realm, nonce string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.realm, c.nonce
+}
+
+func (c *Client) setChallenge(m *stun.Message) error {
+	var realm stun.Realm
+	var nonce stun.Nonce
+	if err := realm.GetFrom(m); err != nil {
+		return err
+	}
+	if err := nonce.GetFrom(m); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.realm = string(realm)
+	c.nonce = string(nonce)
+	return nil
+}
+
+// Poke sends a single turnrpc request, such as "s:123", in an Allocate and
+// returns the bytes decoded from the relayed address of the reply.
+func (c *Client) Poke(ctx context.Context, req string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", c.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	username := c.prefix() + req
+	if c.Attribute {
+		username = c.Username
+	} else if c.Username != "" {
+		username = c.Username + ":" + username
+	}
+	challenged := false
+	delay := initialPollDelay
+	for {
+		realm, nonce := c.challenge()
+		setters := []stun.Setter{
+			stun.TransactionID,
+			stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+			stun.RawAttribute{
+				Type:  stun.AttrRequestedTransport,
+				Value: []byte{17, 0, 0, 0}, // UDP
+			},
+		}
+		if c.Attribute {
+			setters = append(setters, stun.RawAttribute{Type: attrTurnrpc, Value: []byte(req)})
+		}
+		integrity := stun.NewLongTermIntegrity(username, realm, c.password())
+		if nonce != "" {
+			setters = append(setters,
+				stun.NewUsername(username),
+				stun.NewRealm(realm),
+				stun.NewNonce(nonce),
+				integrity,
+			)
+		}
+		msg, err := stun.Build(setters...)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := roundTrip(ctx, conn, msg)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Type.Class == stun.ClassErrorResponse {
+			var code stun.ErrorCodeAttribute
+			if err := code.GetFrom(resp); err != nil {
+				return nil, err
+			}
+			// back off while rate limited, for as long as the timeout allows
+			if code.Code == stun.CodeAllocQuotaReached {
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return nil, fmt.Errorf("%w: %s", ErrRateLimited, req)
+				}
+				delay = min(delay*2, maxPollDelay)
+				continue
+			}
+			// The server answers both missing credentials and rejected
+			// requests with 401, so only retry once with a fresh nonce,
+			// as after a 438 for an expired one.
+			if code.Code != stun.CodeUnauthorized && code.Code != stun.CodeStaleNonce || challenged {
+				return nil, fmt.Errorf("%w: %s: %s", ErrRejected, req, code)
+			}
+			if err := c.setChallenge(resp); err != nil {
+				return nil, err
+			}
+			challenged = true
+			continue
+		}
+		if err := integrity.Check(resp); err != nil {
+			return nil, err
+		}
+		return decodeRelayed(resp)
+	}
+}
+
+// roundTrip sends msg on conn, retransmitting with exponential backoff
+// until a response with the same transaction ID arrives or ctx is done.
+func roundTrip(ctx context.Context, conn net.Conn, msg *stun.Message) (*stun.Message, error) {
+	buf := make([]byte, 1500)
+	rto := initialRTO
+	for {
+		if _, err := conn.Write(msg.Raw); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(rto)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetReadDeadline(deadline)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			resp := &stun.Message{}
+			if err := stun.Decode(buf[:n], resp); err != nil {
+				continue
+			}
+			if resp.TransactionID != msg.TransactionID {
+				continue
+			}
+			return resp, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		rto *= 2
+	}
+}
+
+func decodeRelayed(m *stun.Message) ([]byte, error) {
+	var addr stun.XORMappedAddress
+	if err := addr.GetFromAs(m, stun.AttrXORRelayedAddress); err != nil {
+		return nil, err
+	}
+	ip := addr.IP.To16()
+	n := addr.Port >> 8 & 0x1f
+	if ip == nil || n > 16 {
+		return nil, errors.New("turnx: invalid relayed address")
+	}
+	data := make([]byte, 16)
+	copy(data, ip)
+	data[0] = byte(addr.Port)
+	return data[:n], nil
+}
+
+// Call sends req through the turnx server and returns the backend's
+// response. req is compressed with the shared dictionary, uploaded with s:
+// and c:, executed with e:, polled with p: and read back with r:.
+func (c *Client) Call(ctx context.Context, req []byte) ([]byte, error) {
+	cfg, err := c.config(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return call(ctx, req, c.Poke, cfg)
+}
+
+// Receive takes the next message from the mailbox name, see Server.Publish.
+// It returns ErrNoMessage if the mailbox is empty.
+func (c *Client) Receive(ctx context.Context, name string) ([]byte, error) {
+	id, err := c.Poke(ctx, "q:"+name)
+	if err != nil {
+		return nil, err
+	}
+	if len(id) == 0 {
+		return nil, ErrNoMessage
+	}
+	b64id := base64.StdEncoding.EncodeToString(id)
+	n, err := waitResponse(ctx, c.Poke, "p:"+b64id, b64id)
+	if err != nil {
+		return nil, err
+	}
+	return readRange(ctx, c.Poke, b64id, 0, n)
+}
+
+// Capabilities asks the server what it supports with v:.
+func (c *Client) Capabilities(ctx context.Context) (*Capabilities, error) {
+	b, err := c.Poke(ctx, "v:")
+	if err != nil {
+		return nil, err
+	}
+	return parseCapabilities(b)
+}
+
+// config negotiates the parameters of Call with the server once. Servers
+// that predate v: get the parameters of the browser client.
+func (c *Client) config(ctx context.Context) (callConfig, error) {
+	c.mu.Lock()
+	caps := c.caps
+	c.mu.Unlock()
+	if caps == nil {
+		var err error
+		caps, err = c.Capabilities(ctx)
+		if errors.Is(err, ErrRejected) {
+			caps = &Capabilities{MaxChunkSize: reqPartSize}
+		} else if err != nil {
+			return callConfig{}, err
+		}
+		c.mu.Lock()
+		c.caps = caps
+		c.mu.Unlock()
+	}
+
+	cfg := callConfig{
+		chunkSize: min(caps.MaxChunkSize, c.maxChunk()),
+		dict:      c.Dictionary,
+		verify:    caps.Version >= checksumVersion,
+		datagrams: caps.Datagrams,
+	}
+	if cfg.dict == nil {
+		cfg.dict = dict
+	} else if len(cfg.dict) == 0 {
+		cfg.dict = nil
+	}
+	if c.Codec != "" {
+		var err error
+		if cfg.codec, err = parseCodec(c.Codec); err != nil {
+			return callConfig{}, err
+		}
+	}
+	return cfg, nil
+}
+
+// callConfig holds the parameters of a call negotiated with the server.
+type callConfig struct {
+	chunkSize int
+	codec     codec
+	dict      []byte
+	// verify re-sends the chunks the server did not receive and has it
+	// check a CRC-32 of the request before executing it.
+	verify bool
+	// datagrams keeps every Tunnel.Write in a single w:.
+	datagrams bool
+}
+
+// pokeFunc sends a single turnrpc request and returns the decoded reply.
+type pokeFunc func(ctx context.Context, req string) ([]byte, error)
+
+func call(ctx context.Context, req []byte, poke pokeFunc, cfg callConfig) ([]byte, error) {
+	// compress the request using the preset dictionary
+	comped, err := cfg.codec.compress(req, cfg.dict)
+	if err != nil {
+		return nil, err
+	}
+
+	// allocate a request id
+	startReq := "s:" + strconv.Itoa(len(comped))
+	if cfg.codec != codecZlib {
+		startReq += ":" + cfg.codec.String()
+	}
+	id, err := poke(ctx, startReq)
+	if err != nil {
+		return nil, err
+	}
+	b64id := base64.StdEncoding.EncodeToString(id)
+
+	// send the request parts, then re-send what the server reports missing
+	missing := []span{{0, len(comped)}}
+	for round := 0; ; round++ {
+		jobs := uploadJobs(ctx, poke, b64id, comped, missing, cfg.chunkSize)
+		if cfg.verify {
+			// lost chunks are found with m: instead
+			for i, job := range jobs {
+				jobs[i] = func() error {
+					job()
+					return ctx.Err()
+				}
+			}
+		}
+		err := runBatches(jobs)
+		if !cfg.verify {
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		missing, err = missingRanges(ctx, poke, b64id)
+		if err != nil {
+			return nil, err
+		}
+		if len(missing) == 0 {
+			break
+		}
+		if round == maxUploadRounds {
+			return nil, errors.New("turnx: request upload incomplete")
+		}
+	}
+
+	// execute the request and wait for the response
+	execReq := "e:" + b64id
+	if cfg.verify {
+		execReq += fmt.Sprintf(":%08x", crc32.ChecksumIEEE(comped))
+	}
+	respLen, err := waitResponse(ctx, poke, execReq, b64id)
+	if err != nil {
+		return nil, err
+	}
+
+	// retrieve the response parts
+	respBuf, err := readRange(ctx, poke, b64id, 0, respLen)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.codec.decompress(respBuf, cfg.dict, maxDecompressedSize)
+}
+
+// readRange reads bytes from up to to of the response of b64id with r:.
+func readRange(ctx context.Context, poke pokeFunc, b64id string, from, to int) ([]byte, error) {
+	respBuf := make([]byte, to-from)
+	var jobs []func() error
+	for i := from; i < to; i += 16 {
+		req := fmt.Sprintf("r:%s:%d", b64id, i)
+		jobs = append(jobs, func() error {
+			part, err := poke(ctx, req)
+			if err != nil {
+				return err
+			}
+			copy(respBuf[i-from:], part)
+			return nil
+		})
+	}
+	if err := runBatches(jobs); err != nil {
+		return nil, err
+	}
+	return respBuf, nil
+}
+
+// uploadJobs returns the c: pokes sending the spans of comped.
+func uploadJobs(ctx context.Context, poke pokeFunc, b64id string, comped []byte, spans []span, chunkSize int) []func() error {
+	var jobs []func() error
+	for _, r := range spans {
+		for i := r.start; i < r.end; i += chunkSize {
+			part := comped[i:min(i+chunkSize, r.end)]
+			req := fmt.Sprintf("c:%s:%d:%s", b64id, i, base64.StdEncoding.EncodeToString(part))
+			jobs = append(jobs, func() error {
+				_, err := poke(ctx, req)
+				return err
+			})
+		}
+	}
+	return jobs
+}
+
+// missingRanges asks the server with m: which parts of the request it has
+// not received yet.
+func missingRanges(ctx context.Context, poke pokeFunc, b64id string) ([]span, error) {
+	var spans []span
+	from := 0
+	for {
+		reply, err := poke(ctx, fmt.Sprintf("m:%s:%d", b64id, from))
+		if err != nil {
+			return nil, err
+		}
+		if len(reply)%8 != 0 {
+			return nil, errors.New("turnx: invalid missing ranges")
+		}
+		for b := reply; len(b) > 0; b = b[8:] {
+			start := int(binary.BigEndian.Uint32(b))
+			end := start + int(binary.BigEndian.Uint32(b[4:]))
+			if start < from || end <= start {
+				return nil, errors.New("turnx: invalid missing ranges")
+			}
+			spans = append(spans, span{start, end})
+			from = end
+		}
+		if len(reply) < missingPerReply*8 {
+			return spans, nil
+		}
+	}
+}
+
+// waitResponse executes the request with e: and polls it with p: until the
+// backend has answered, returning the length of the compressed response.
+// Servers that predate p: answer e: with the length directly.
+func waitResponse(ctx context.Context, poke pokeFunc, execReq, b64id string) (int, error) {
+	reply, err := poke(ctx, execReq)
+	delay := initialPollDelay
+	for {
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case len(reply) == 4:
+			return int(binary.BigEndian.Uint32(reply)), nil
+		case len(reply) == 5 && execStatus(reply[0]) == statusDone:
+			return int(binary.BigEndian.Uint32(reply[1:])), nil
+		case len(reply) == 1 && execStatus(reply[0]) == statusFailed:
+			return 0, errors.New("turnx: backend failed")
+		case len(reply) != 1 || execStatus(reply[0]) != statusPending:
+			return 0, errors.New("turnx: invalid execution status")
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+		delay = min(delay*2, maxPollDelay)
+		reply, err = poke(ctx, "p:"+b64id)
+	}
+}
+
+// runBatches runs jobs batchSize at a time and stops at the first batch
+// that fails.
+func runBatches(jobs []func() error) error {
+	for len(jobs) > 0 {
+		batch := jobs[:min(batchSize, len(jobs))]
+		jobs = jobs[len(batch):]
+		errs := make([]error, len(batch))
+		var wg sync.WaitGroup
+		for i, job := range batch {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = job()
+			}()
+		}
+		wg.Wait()
+		if err := errors.Join(errs...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
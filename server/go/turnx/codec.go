@@ -0,0 +1,128 @@
+package turnx
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/adler32"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// codec compresses request and response bodies. Its value is the bit of the
+// codec in the capability record, and its name is what s: accepts as its
+// optional second field, e.g. "s:<length>:zstd".
+type codec uint8
+
+const (
+	codecZlib codec = iota
+	codecZstd
+)
+
+// codecNames lists the compression codecs by their bit in the capability
+// record.
+var codecNames = []string{"zlib", "zstd"}
+
+func parseCodec(s string) (codec, error) {
+	for i, name := range codecNames {
+		if s == name {
+			return codec(i), nil
+		}
+	}
+	return 0, errors.New("Unknown codec")
+}
+
+func (c codec) String() string {
+	return codecNames[c]
+}
+
+// dictID returns the id of the dictionary named in the header of data, and
+// whether data uses a dictionary at all. Both codecs use the Adler-32 of the
+// dictionary: zlib as its DICTID, zstd as the raw dictionary id.
+func (c codec) dictID(data []byte) (uint32, bool, error) {
+	if c == codecZstd {
+		var h zstd.Header
+		if err := h.Decode(data); err != nil {
+			return 0, false, err
+		}
+		return h.DictionaryID, h.DictionaryID != 0, nil
+	}
+	if len(data) < 2 || (uint16(data[0])<<8|uint16(data[1]))%31 != 0 {
+		return 0, false, errors.New("Invalid zlib header")
+	}
+	if data[1]&0x20 == 0 {
+		return 0, false, nil
+	}
+	if len(data) < 6 {
+		return 0, false, errors.New("Invalid zlib header")
+	}
+	return binary.BigEndian.Uint32(data[2:6]), true, nil
+}
+
+// compress compresses data with dict, or without a dictionary if dict is nil.
+func (c codec) compress(data, dict []byte) ([]byte, error) {
+	if c == codecZstd {
+		opts := []zstd.EOption{
+			zstd.WithEncoderLevel(zstd.SpeedBestCompression),
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithEncoderCRC(false),
+		}
+		if dict != nil {
+			opts = append(opts, zstd.WithEncoderDictRaw(adler32.Checksum(dict), dict))
+		}
+		z, err := zstd.NewWriter(nil, opts...)
+		if err != nil {
+			return nil, err
+		}
+		defer z.Close()
+		return z.EncodeAll(data, nil), nil
+	}
+	w := &bytes.Buffer{}
+	z, err := zlib.NewWriterLevelDict(w, zlib.BestCompression, dict)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := z.Write(data); err != nil {
+		return nil, err
+	}
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+// decompress reverses compress, failing if the result exceeds limit bytes.
+func (c codec) decompress(data, dict []byte, limit int) ([]byte, error) {
+	var r io.Reader
+	if c == codecZstd {
+		opts := []zstd.DOption{
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(uint64(limit)),
+		}
+		if dict != nil {
+			opts = append(opts, zstd.WithDecoderDictRaw(adler32.Checksum(dict), dict))
+		}
+		z, err := zstd.NewReader(bytes.NewReader(data), opts...)
+		if err != nil {
+			return nil, err
+		}
+		defer z.Close()
+		r = z
+	} else {
+		z, err := zlib.NewReaderDict(bytes.NewReader(data), dict)
+		if err != nil {
+			return nil, err
+		}
+		r = z
+	}
+	out, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > limit {
+		return nil, errors.New("Content too long")
+	}
+	return out, nil
+}
@@ -0,0 +1,224 @@
+package turnx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/ice/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+// The tests in this file use pion/webrtc as a stand-in browser: every poke
+// is a fresh relay-only PeerConnection whose relay candidate is decoded the
+// same way client/src/turnx.ts does it.
+
+func startServer(t testing.TB, backend Backend) string {
+	t.Helper()
+	return serve(t, newTestServer(t, backend))
+}
+
+func serve(t testing.TB, srv *Server) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go srv.Serve(conn)
+	return conn.LocalAddr().String()
+}
+
+// echoHandler answers with the method, URI and body of the request.
+var echoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, "%s %s\n", r.Method, r.RequestURI)
+	w.Write(body)
+})
+
+func webrtcPoke(t testing.TB, addr string) pokeFunc {
+	se := webrtc.SettingEngine{}
+	se.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+	se.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(se))
+
+	return func(ctx context.Context, req string) ([]byte, error) {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		pc, err := api.NewPeerConnection(webrtc.Configuration{
+			ICEServers: []webrtc.ICEServer{{
+				URLs:       []string{"turn:" + addr},
+				Username:   defaultPrefix + req,
+				Credential: defaultPassword,
+			}},
+			ICETransportPolicy: webrtc.ICETransportPolicyRelay,
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer pc.Close()
+		if _, err := pc.CreateDataChannel("data", nil); err != nil {
+			return nil, err
+		}
+
+		var mu sync.Mutex
+		var data []byte
+		pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+			if c == nil {
+				return
+			}
+			parts := strings.Split(c.ToJSON().Candidate, " ")
+			if len(parts) < 8 || parts[7] != "relay" {
+				return
+			}
+			ip := net.ParseIP(parts[4]).To16()
+			port, err := strconv.Atoi(parts[5])
+			if ip == nil || err != nil {
+				t.Errorf("unparseable relay candidate %q", c.ToJSON().Candidate)
+				return
+			}
+			n := port >> 8 & 0x1f
+			if n > 16 {
+				return
+			}
+			ip[0] = byte(port)
+			mu.Lock()
+			data = bytes.Clone(ip[:n])
+			mu.Unlock()
+		})
+
+		gathered := webrtc.GatheringCompletePromise(pc)
+		offer, err := pc.CreateOffer(nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := pc.SetLocalDescription(offer); err != nil {
+			return nil, err
+		}
+		select {
+		case <-gathered:
+		case <-ctx.Done():
+			return nil, errors.New("timeout while waiting for STUN response")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if data == nil {
+			return nil, errors.New("no data, is the server reachable?")
+		}
+		return data, nil
+	}
+}
+
+func TestE2EPoke(t *testing.T) {
+	addr := startServer(t, &HandlerBackend{Handler: echoHandler})
+	poke := webrtcPoke(t, addr)
+	client := &Client{Addr: addr}
+	ctx := context.Background()
+
+	id, err := poke(ctx, "s:4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(id) != 16 {
+		t.Fatalf("s: returned %d bytes, want 16", len(id))
+	}
+	b64id := base64.StdEncoding.EncodeToString(id)
+	got, err := poke(ctx, "c:"+b64id+":0:AAAA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, id) {
+		t.Errorf("c: returned %x, want %x", got, id)
+	}
+	want, err := client.Poke(ctx, "c:"+b64id+":1:AAA=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("browser decoded %x, client decoded %x", got, want)
+	}
+}
+
+func TestE2ERoundTrip(t *testing.T) {
+	addr := startServer(t, &HandlerBackend{Handler: echoHandler})
+	poke := webrtcPoke(t, addr)
+
+	random := make([]byte, 6000)
+	rand.Read(random)
+	large := base64.StdEncoding.EncodeToString(random)
+
+	tests := []struct {
+		name   string
+		method string
+		uri    string
+		body   string
+	}{
+		{"get", "GET", "/", ""},
+		{"small post", "POST", "/echo?x=1", "hello, world"},
+		{"multi-chunk post", "PUT", "/large", large},
+	}
+	for _, tt := range tests {
+		for _, c := range []codec{codecZlib, codecZstd} {
+			t.Run(tt.name+"/"+c.String(), func(t *testing.T) {
+				req := fmt.Sprintf("%s %s HTTP/1.1\r\nHost: localhost\r\nContent-Length: %d\r\n\r\n%s",
+					tt.method, tt.uri, len(tt.body), tt.body)
+				cfg := callConfig{chunkSize: reqPartSize, codec: c, dict: dict, verify: true}
+				resp, err := call(context.Background(), []byte(req), poke, cfg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				httpResp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(resp)), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, err := io.ReadAll(httpResp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := tt.method + " " + tt.uri + "\n" + tt.body
+				if httpResp.StatusCode != http.StatusOK || string(body) != want {
+					t.Errorf("got %d %q, want 200 %q", httpResp.StatusCode, body, want)
+				}
+			})
+		}
+	}
+}
+
+func TestE2ECapabilities(t *testing.T) {
+	addr := startServer(t, &HandlerBackend{Handler: echoHandler})
+	poke := webrtcPoke(t, addr)
+	client := &Client{Addr: addr}
+	ctx := context.Background()
+
+	b, err := poke(ctx, "v:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseCapabilities(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := client.Capabilities(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != protocolVersion || got.DictID != want.DictID || got.MaxChunkSize != want.MaxChunkSize {
+		t.Errorf("browser decoded %+v, client decoded %+v", got, want)
+	}
+}
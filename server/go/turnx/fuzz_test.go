@@ -0,0 +1,183 @@
+package turnx
+
+import (
+	"encoding/base64"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/stun/v2"
+)
+
+func FuzzTurnpoke(f *testing.F) {
+	for _, seed := range []string{
+		"s:0",
+		"s:10",
+		"s:-1",
+		"s:99999999999999999999",
+		"s:10:zlib",
+		"s:10:zstd",
+		"s:10:",
+		"s:10:br",
+		"c:$id:0:AAAA",
+		"c:$id:6:AAAA",
+		"c:$id:-1:AAAA",
+		"c:$id:9:AAAA",
+		"c:$id:0",
+		"c:$id",
+		"c:AAAA:0:AAAA",
+		"e:$id",
+		"e:$done",
+		"e:$id:00000000",
+		"e:$id:0000000000000000000000000000000000000000000000000000000000000000",
+		"e:$id:zz",
+		"e:$id:",
+		"m:$id",
+		"m:$id:4",
+		"m:$id:9",
+		"m:$done",
+		"m:",
+		"r:$done:0",
+		"r:$done:16",
+		"r:$done:100000",
+		"r:$done",
+		"r:$id:0",
+		"p:$done",
+		"p:$id",
+		"p:",
+		"q:inbox",
+		"q:empty",
+		"q:",
+		"o:",
+		"o:1",
+		"w:$id:0:AAAA",
+		"w:$stream:0:aGVsbG8=",
+		"w:$stream:3:bG8gd29ybGQ=",
+		"w:$stream:65536:AAAA",
+		"w:$stream:0:",
+		"w:$stream:0",
+		"p:$stream",
+		"p:$stream:0",
+		"p:$stream:5",
+		"p:$stream:0:0",
+		"r:$stream:0",
+		"r:$stream:99",
+		"r:$stream",
+		"x:$stream",
+		"x:$stream:0",
+		"x:$id",
+		"v:",
+		"v:1",
+		"x:",
+		":",
+		"",
+	} {
+		f.Add(seed)
+	}
+
+	s := newTestServerWith(f, Options{
+		Backend:       &HandlerBackend{Handler: echoHandler},
+		StreamBackend: echoStreamBackend{},
+		Validity:      time.Hour,
+	})
+	// $done names a request that has been executed and can be read.
+	comped := compressed(f, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	id, err := s.turnpoke(nil, nil, "s:"+strconv.Itoa(len(comped)))
+	if err != nil {
+		f.Fatal(err)
+	}
+	done := base64.StdEncoding.EncodeToString(id)
+	if _, err := s.turnpoke(nil, nil, "c:"+done+":0:"+base64.StdEncoding.EncodeToString(comped)); err != nil {
+		f.Fatal(err)
+	}
+	if _, err := s.turnpoke(nil, nil, "e:"+done); err != nil {
+		f.Fatal(err)
+	}
+	for {
+		status, err := s.turnpoke(nil, nil, "p:"+done)
+		if err != nil {
+			f.Fatal(err)
+		}
+		if execStatus(status[0]) == statusDone {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	f.Fuzz(func(t *testing.T, req string) {
+		s.Publish("inbox", []byte("hello"))
+		// $id names a fresh request of 8 bytes.
+		id, err := s.turnpoke(nil, nil, "s:8")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// $stream names a fresh stream session.
+		stream, err := s.turnpoke(nil, nil, "o:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b64stream := base64.StdEncoding.EncodeToString(stream)
+		defer s.turnpoke(nil, nil, "x:"+b64stream)
+		req = strings.ReplaceAll(req, "$id", base64.StdEncoding.EncodeToString(id))
+		req = strings.ReplaceAll(req, "$done", done)
+		req = strings.ReplaceAll(req, "$stream", b64stream)
+		if strings.HasPrefix(req, "o:") {
+			if id, err := s.turnpoke(nil, nil, req); err == nil {
+				defer s.turnpoke(nil, nil, "x:"+base64.StdEncoding.EncodeToString(id))
+			}
+			return
+		}
+		s.turnpoke(nil, nil, req)
+	})
+}
+
+func FuzzCheckAuth(f *testing.F) {
+	f.Add(buildRequest(f, stun.MethodAllocate, "s:10"))
+	f.Add(buildRequest(f, stun.MethodRefresh, "s:10"))
+	f.Add(stun.MustBuild(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest)).Raw)
+	f.Add(stun.MustBuild(
+		stun.TransactionID,
+		stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+		stun.NewUsername("someone"),
+		stun.NewRealm(defaultRealm),
+		stun.NewNonce("nonce"),
+		stun.NewShortTermIntegrity("password"),
+	).Raw)
+
+	s := newTestServer(f, &HandlerBackend{Handler: echoHandler})
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		msg := &stun.Message{}
+		if err := stun.Decode(raw, msg); err != nil {
+			return
+		}
+		s.checkAuth(msg, net.IPv4(127, 0, 0, 1))
+	})
+}
+
+func FuzzHandleRequest(f *testing.F) {
+	f.Add(stun.MustBuild(stun.TransactionID, stun.BindingRequest).Raw)
+	f.Add(stun.MustBuild(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest)).Raw)
+	f.Add(buildRequest(f, stun.MethodAllocate, "s:10"))
+	f.Add(buildRequest(f, stun.MethodAllocate, "c:AAAAAAAAAAAAAAAAAAAAAA==:0:AAAA"))
+	f.Add(buildRequest(f, stun.MethodAllocate, "r:AAAAAAAAAAAAAAAAAAAAAA==:0"))
+	f.Add(buildRequest(f, stun.MethodRefresh, "", stun.RawAttribute{
+		Type:  stun.AttrLifetime,
+		Value: []byte{0, 0, 0, 0},
+	}))
+	f.Add(buildRequest(f, stun.MethodRefresh, "", stun.RawAttribute{
+		Type:  stun.AttrLifetime,
+		Value: []byte{0, 0, 0, 1},
+	}))
+
+	s := newTestServer(f, &HandlerBackend{Handler: echoHandler})
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3478}
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		msg := &stun.Message{}
+		if err := stun.Decode(raw, msg); err != nil {
+			return
+		}
+		s.handleRequest(discardConn{}, addr, msg)
+	})
+}
@@ -0,0 +1,133 @@
+package turnx
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// maxMailboxMessages bounds the messages waiting in a mailbox.
+	maxMailboxMessages = 256
+	// maxMessageSize bounds a single message.
+	maxMessageSize = 64 << 10
+	// maxMailboxName bounds mailbox names, which travel in the USERNAME.
+	maxMailboxName = 256
+	// maxMailboxes bounds the mailboxes holding messages.
+	maxMailboxes = 4096
+	// mailboxIdleTimeout is how long a mailbox is kept once nothing is
+	// published to it or taken from it.
+	mailboxIdleTimeout = 10 * time.Minute
+)
+
+var (
+	// ErrMailboxFull is returned by Publish when the mailbox already holds
+	// as many messages as it can.
+	ErrMailboxFull = errors.New("turnx: mailbox full")
+	// ErrTooManyMailboxes is returned by Publish for a new mailbox when
+	// the server already holds as many as it can.
+	ErrTooManyMailboxes = errors.New("turnx: too many mailboxes")
+	// ErrInvalidMessage is returned by Publish for empty mailbox names and
+	// messages that are too long.
+	ErrInvalidMessage = errors.New("turnx: invalid message")
+)
+
+// mailbox is the queue of messages of a mailbox, guarded by longReqLock.
+type mailbox struct {
+	messages [][]byte
+	touched  time.Time // when a message was last published or taken
+}
+
+// Publish queues msg in the mailbox name, for a client to take with q:.
+// Mailboxes exist while they hold messages, and are dropped with their
+// messages once none has been published or taken for 10 minutes. Anyone
+// who knows the name of a mailbox can drain it, so names should be hard to
+// guess.
+func (s *Server) Publish(name string, msg []byte) error {
+	if name == "" || len(name) > maxMailboxName || len(msg) > maxMessageSize {
+		return ErrInvalidMessage
+	}
+	s.longReqLock.Lock()
+	defer s.longReqLock.Unlock()
+	mb := s.mailboxes[name]
+	if mb == nil {
+		if len(s.mailboxes) >= maxMailboxes {
+			return ErrTooManyMailboxes
+		}
+		mb = &mailbox{}
+		s.mailboxes[name] = mb
+	}
+	if len(mb.messages) >= maxMailboxMessages {
+		return ErrMailboxFull
+	}
+	mb.messages = append(mb.messages, append([]byte(nil), msg...))
+	mb.touched = s.now()
+	return nil
+}
+
+// takeMessage moves the next message of the mailbox name into a new
+// executed request and returns its id, or nil if the mailbox is empty. The
+// lock must be held.
+func (s *Server) takeMessage(name string) []byte {
+	mb := s.mailboxes[name]
+	if mb == nil {
+		return nil
+	}
+	msg := mb.messages[0]
+	if len(mb.messages) == 1 {
+		delete(s.mailboxes, name)
+	} else {
+		mb.messages = mb.messages[1:]
+		mb.touched = s.now()
+	}
+	id := make([]byte, idSize)
+	rand.Read(id)
+	s.longReqValidUntils[string(id)] = time.Now().Add(s.validity)
+	s.longStatuses[string(id)] = statusDone
+	s.longResps[string(id)] = msg
+	return id
+}
+
+// reapMailboxes drops the mailboxes that have been idle for too long.
+func (s *Server) reapMailboxes() {
+	s.longReqLock.Lock()
+	defer s.longReqLock.Unlock()
+	now := s.now()
+	for name, mb := range s.mailboxes {
+		if now.Sub(mb.touched) >= mailboxIdleTimeout {
+			delete(s.mailboxes, name)
+		}
+	}
+}
+
+// AdminHandler returns a handler publishing the body of POST
+// /mailboxes/<name> to the mailbox name. It is meant for backends and must
+// not be exposed to clients.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mailboxes/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/mailboxes/")
+		msg, err := io.ReadAll(io.LimitReader(r.Body, maxMessageSize+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch err := s.Publish(name, msg); err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case ErrMailboxFull, ErrTooManyMailboxes:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	})
+	return mux
+}
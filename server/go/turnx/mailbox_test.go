@@ -0,0 +1,122 @@
+package turnx
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMailbox(t *testing.T) {
+	srv := newTestServer(t, &HandlerBackend{Handler: echoHandler})
+	addr := serve(t, srv)
+	admin := httptest.NewServer(srv.AdminHandler())
+	t.Cleanup(admin.Close)
+	client := &Client{Addr: addr}
+	ctx := context.Background()
+
+	long := bytes.Repeat([]byte("notification "), 10)
+	for _, msg := range [][]byte{[]byte("first"), long} {
+		resp, err := http.Post(admin.URL+"/mailboxes/inbox", "application/octet-stream", bytes.NewReader(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("publish returned %s", resp.Status)
+		}
+	}
+	if err := srv.Publish("inbox", []byte("last")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the browser path: q: returns an id whose message is read with p: and r:
+	poke := webrtcPoke(t, addr)
+	id, err := poke(ctx, "q:inbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64id := base64.StdEncoding.EncodeToString(id)
+	n, err := waitResponse(ctx, poke, "p:"+b64id, b64id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readRange(ctx, poke, b64id, 0, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "first" {
+		t.Errorf("got %q, want %q", got, "first")
+	}
+
+	for _, want := range [][]byte{long, []byte("last")} {
+		got, err := client.Receive(ctx, "inbox")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	if _, err := client.Receive(ctx, "inbox"); !errors.Is(err, ErrNoMessage) {
+		t.Errorf("empty mailbox: got %v, want ErrNoMessage", err)
+	}
+}
+
+func TestMailboxLimits(t *testing.T) {
+	srv := newTestServer(t, &HandlerBackend{Handler: echoHandler})
+	for i := range maxMailboxes {
+		if err := srv.Publish(strconv.Itoa(i), []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := srv.Publish("new", []byte("x")); !errors.Is(err, ErrTooManyMailboxes) {
+		t.Errorf("new mailbox: got %v, want ErrTooManyMailboxes", err)
+	}
+	if err := srv.Publish("0", []byte("y")); err != nil {
+		t.Errorf("existing mailbox: %v", err)
+	}
+	for range 2 {
+		srv.turnpoke(nil, nil, "q:1")
+	}
+	if err := srv.Publish("new", []byte("x")); err != nil {
+		t.Errorf("new mailbox once one is drained: %v", err)
+	}
+	for range maxMailboxMessages - 2 {
+		srv.Publish("0", []byte("z"))
+	}
+	if err := srv.Publish("0", []byte("z")); !errors.Is(err, ErrMailboxFull) {
+		t.Errorf("full mailbox: got %v, want ErrMailboxFull", err)
+	}
+}
+
+func TestMailboxExpiry(t *testing.T) {
+	clock := newTestClock()
+	srv := newTestServerWith(t, Options{
+		Backend:  &HandlerBackend{Handler: echoHandler},
+		Validity: time.Hour,
+		now:      clock.Now,
+	})
+	for _, name := range []string{"idle", "busy", "busy"} {
+		if err := srv.Publish(name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.Advance(mailboxIdleTimeout / 2)
+	if id, _ := srv.turnpoke(nil, nil, "q:busy"); len(id) == 0 {
+		t.Fatal("busy mailbox empty")
+	}
+	clock.Advance(mailboxIdleTimeout / 2)
+	srv.reapMailboxes()
+	if id, _ := srv.turnpoke(nil, nil, "q:idle"); len(id) != 0 {
+		t.Error("idle mailbox kept")
+	}
+	if id, _ := srv.turnpoke(nil, nil, "q:busy"); len(id) == 0 {
+		t.Error("mailbox taken from recently dropped")
+	}
+}
@@ -0,0 +1,51 @@
+package turnx
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"time"
+)
+
+// defaultNonceValidity is how long a NONCE is accepted by default.
+const defaultNonceValidity = 10 * time.Minute
+
+// makeNonce returns a NONCE issued to ip at t: the timestamp followed by an
+// HMAC binding it to ip, both in hex. Nonces need no state on the server,
+// and are only accepted from the address they were issued to.
+func makeNonce(key []byte, ip net.IP, t time.Time) string {
+	ts := binary.BigEndian.AppendUint64(nil, uint64(t.Unix()))
+	return hex.EncodeToString(ts) + hex.EncodeToString(nonceMAC(key, ip, ts))
+}
+
+func nonceMAC(key []byte, ip net.IP, ts []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(ts)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	mac.Write(ip)
+	return mac.Sum(nil)[:16]
+}
+
+// newNonce returns a fresh NONCE for ip.
+func (s *Server) newNonce(ip net.IP) string {
+	return makeNonce(s.nonceKey, ip, s.now())
+}
+
+// checkNonce reports whether nonce was issued to ip by this server and has
+// not expired.
+func (s *Server) checkNonce(nonce []byte, ip net.IP) bool {
+	b, err := hex.DecodeString(string(nonce))
+	if err != nil || len(b) != 8+16 {
+		return false
+	}
+	if !hmac.Equal(b[8:], nonceMAC(s.nonceKey, ip, b[:8])) {
+		return false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(b)), 0)
+	age := s.now().Sub(issued)
+	return age >= 0 && age < s.nonceValidity
+}
@@ -0,0 +1,104 @@
+package turnx
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/stun/v2"
+)
+
+func TestStaleNonce(t *testing.T) {
+	clock := newTestClock()
+	addr := serve(t, newTestServerWith(t, Options{
+		Backend:       &HandlerBackend{Handler: echoHandler},
+		NonceValidity: time.Second,
+		now:           clock.Now,
+	}))
+	ctx := context.Background()
+
+	// a nonce issued to another address is stale, although authentic
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	username := defaultPrefix + "v:"
+	msg := stun.MustBuild(
+		stun.TransactionID,
+		stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+		stun.NewUsername(username),
+		stun.NewRealm(defaultRealm),
+		stun.NewNonce(makeNonce(testNonceKey, net.IPv4(192, 0, 2, 1), time.Now())),
+		stun.NewLongTermIntegrity(username, defaultRealm, defaultPassword),
+	)
+	resp, err := roundTrip(ctx, conn, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var code stun.ErrorCodeAttribute
+	var nonce stun.Nonce
+	if err := code.GetFrom(resp); err != nil || code.Code != stun.CodeStaleNonce {
+		t.Errorf("got %v, %v, want 438", code, err)
+	}
+	if err := nonce.GetFrom(resp); err != nil {
+		t.Error(err)
+	}
+
+	// the client gets a fresh nonce once its own has expired
+	client := &Client{Addr: addr}
+	if _, err := client.Poke(ctx, "v:"); err != nil {
+		t.Fatal(err)
+	}
+	_, first := client.challenge()
+	clock.Advance(time.Second)
+	if _, err := client.Poke(ctx, "v:"); err != nil {
+		t.Fatal(err)
+	}
+	if _, second := client.challenge(); second == first {
+		t.Error("nonce was not renewed")
+	}
+}
+
+func TestCheckNonce(t *testing.T) {
+	clock := newTestClock()
+	srv := newTestServerWith(t, Options{
+		Backend:       &HandlerBackend{Handler: echoHandler},
+		NonceValidity: time.Minute,
+		now:           clock.Now,
+	})
+	ip := net.IPv4(192, 0, 2, 1)
+	nonce := []byte(srv.newNonce(ip))
+	if !srv.checkNonce(nonce, ip) {
+		t.Error("fresh nonce rejected")
+	}
+	if !srv.checkNonce(nonce, ip.To16()) {
+		t.Error("fresh nonce rejected from the IPv4-mapped address")
+	}
+	if srv.checkNonce(nonce, net.IPv4(192, 0, 2, 2)) {
+		t.Error("nonce accepted from another address")
+	}
+	other := makeNonce([]byte("other key"), ip, clock.Now())
+	if srv.checkNonce([]byte(other), ip) {
+		t.Error("nonce of another key accepted")
+	}
+	future := makeNonce(testNonceKey, ip, clock.Now().Add(time.Minute))
+	if srv.checkNonce([]byte(future), ip) {
+		t.Error("nonce from the future accepted")
+	}
+	for _, bad := range []string{"", "zz", string(nonce[:len(nonce)-2]), string(nonce) + "00"} {
+		if srv.checkNonce([]byte(bad), ip) {
+			t.Errorf("malformed nonce %q accepted", bad)
+		}
+	}
+
+	clock.Advance(time.Minute - time.Second)
+	if !srv.checkNonce(nonce, ip) {
+		t.Error("nonce rejected before it expired")
+	}
+	clock.Advance(time.Second)
+	if srv.checkNonce(nonce, ip) {
+		t.Error("expired nonce accepted")
+	}
+}
@@ -0,0 +1,48 @@
+package turnx
+
+// span is the half-open byte range [start, end).
+type span struct {
+	start, end int
+}
+
+// rangeSet is a sorted list of disjoint, non-adjacent spans.
+type rangeSet []span
+
+// add returns the set with [start, end) added.
+func (r rangeSet) add(start, end int) rangeSet {
+	if start >= end {
+		return r
+	}
+	out := make(rangeSet, 0, len(r)+1)
+	i := 0
+	for ; i < len(r) && r[i].end < start; i++ {
+		out = append(out, r[i])
+	}
+	for ; i < len(r) && r[i].start <= end; i++ {
+		start = min(start, r[i].start)
+		end = max(end, r[i].end)
+	}
+	out = append(out, span{start, end})
+	return append(out, r[i:]...)
+}
+
+// missing returns up to n spans of [from, size) that are not in the set.
+func (r rangeSet) missing(from, size, n int) []span {
+	var out []span
+	for _, s := range r {
+		if len(out) == n || from >= size {
+			return out
+		}
+		if s.end <= from {
+			continue
+		}
+		if s.start > from {
+			out = append(out, span{from, min(s.start, size)})
+		}
+		from = s.end
+	}
+	if len(out) < n && from < size {
+		out = append(out, span{from, size})
+	}
+	return out
+}
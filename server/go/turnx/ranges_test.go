@@ -0,0 +1,51 @@
+package turnx
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRangeSetAdd(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		spans []span
+		want  rangeSet
+	}{
+		{"empty span", []span{{3, 3}}, nil},
+		{"disjoint", []span{{5, 8}, {0, 2}}, rangeSet{{0, 2}, {5, 8}}},
+		{"adjacent", []span{{0, 2}, {2, 4}}, rangeSet{{0, 4}}},
+		{"overlapping", []span{{0, 5}, {3, 8}}, rangeSet{{0, 8}}},
+		{"contained", []span{{0, 8}, {2, 4}}, rangeSet{{0, 8}}},
+		{"bridging", []span{{0, 2}, {4, 6}, {8, 10}, {1, 9}}, rangeSet{{0, 10}}},
+		{"retransmitted", []span{{4, 6}, {4, 6}}, rangeSet{{4, 6}}},
+	} {
+		var r rangeSet
+		for _, s := range tc.spans {
+			r = r.add(s.start, s.end)
+		}
+		if !slices.Equal(r, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, r, tc.want)
+		}
+	}
+}
+
+func TestRangeSetMissing(t *testing.T) {
+	r := rangeSet{{2, 4}, {6, 7}, {9, 10}}
+	for _, tc := range []struct {
+		from, size, n int
+		want          []span
+	}{
+		{0, 12, 10, []span{{0, 2}, {4, 6}, {7, 9}, {10, 12}}},
+		{0, 12, 2, []span{{0, 2}, {4, 6}}},
+		{3, 8, 10, []span{{4, 6}, {7, 8}}},
+		{6, 7, 10, nil},
+		{10, 10, 10, nil},
+	} {
+		if got := r.missing(tc.from, tc.size, tc.n); !slices.Equal(got, tc.want) {
+			t.Errorf("missing(%d, %d, %d): got %v, want %v", tc.from, tc.size, tc.n, got, tc.want)
+		}
+	}
+	if got := rangeSet(nil).missing(0, 5, 1); !slices.Equal(got, []span{{0, 5}}) {
+		t.Errorf("empty set: got %v", got)
+	}
+}
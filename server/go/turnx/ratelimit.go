@@ -0,0 +1,157 @@
+package turnx
+
+import (
+	"encoding/base64"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit is a token bucket refilled with Rate tokens per second and
+// holding up to Burst of them. The zero RateLimit is unlimited.
+type RateLimit struct {
+	Rate float64
+	// Burst defaults to Rate, and at least 1.
+	Burst int
+}
+
+// RateLimits bounds how fast clients may poke, and how fast they may start
+// backend work with e: and o:, which also counts as a poke. Executes are
+// taken by the first e: of a complete request, before it is decompressed,
+// and by o:, not by repeated e:. Limited requests get a 486 error, after
+// which clients should back off.
+type RateLimits struct {
+	// IPPokes and IPExecutes limit each source IP address.
+	IPPokes, IPExecutes RateLimit
+	// UserPokes and UserExecutes limit each authenticated user. A "rate"
+	// attribute of the user replaces the Rate of UserPokes; one that is not
+	// a positive number denies every request of the user.
+	UserPokes, UserExecutes RateLimit
+	// SessionPokes and SessionExecutes limit the pokes naming each
+	// request or stream session.
+	SessionPokes, SessionExecutes RateLimit
+}
+
+// limiterSet holds a token bucket per key.
+type limiterSet struct {
+	mu       sync.Mutex
+	limiters map[string]*limiterEntry
+}
+
+type limiterEntry struct {
+	limiter *rate.Limiter
+	limit   RateLimit
+	refill  time.Duration // how long an unused bucket takes to fill
+	last    time.Time
+}
+
+// allow takes a token at now from the bucket of key, creating it with l if
+// needed. A bucket created with another limit, as after the rate of a user
+// has changed, keeps its tokens but takes on l.
+func (ls *limiterSet) allow(key string, l RateLimit, now time.Time) bool {
+	if l.Rate <= 0 {
+		return true
+	}
+	burst := l.Burst
+	if burst == 0 {
+		burst = max(int(l.Rate), 1)
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	refill := time.Duration(float64(burst) / l.Rate * float64(time.Second))
+	e, ok := ls.limiters[key]
+	switch {
+	case !ok:
+		if ls.limiters == nil {
+			ls.limiters = make(map[string]*limiterEntry)
+		}
+		e = &limiterEntry{limiter: rate.NewLimiter(rate.Limit(l.Rate), burst)}
+		ls.limiters[key] = e
+	case e.limit != l:
+		e.limiter.SetLimitAt(now, rate.Limit(l.Rate))
+		e.limiter.SetBurstAt(now, burst)
+	}
+	e.limit = l
+	e.refill = refill
+	e.last = now
+	return e.limiter.AllowN(now, 1)
+}
+
+// reap forgets the buckets that have filled up again, which are no
+// different from new ones.
+func (ls *limiterSet) reap(now time.Time) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for key, e := range ls.limiters {
+		if now.Sub(e.last) > e.refill {
+			delete(ls.limiters, key)
+		}
+	}
+}
+
+// rateLimiter applies RateLimits.
+type rateLimiter struct {
+	limits                                    RateLimits
+	now                                       func() time.Time
+	ipPokes, userPokes, sessionPokes          limiterSet
+	ipExecutes, userExecutes, sessionExecutes limiterSet
+}
+
+// allowIP takes a poke token of ip, before the request is authenticated.
+func (rl *rateLimiter) allowIP(ip net.IP) bool {
+	return rl.ipPokes.allow(ip.String(), rl.limits.IPPokes, rl.now())
+}
+
+// allow takes the poke tokens req needs besides that of the IP: one of
+// user and of the session req names.
+func (rl *rateLimiter) allow(user *Identity, req string) bool {
+	method, args, _ := strings.Cut(req, ":")
+	session := ""
+	switch method {
+	case "c", "m", "e", "p", "r", "w", "x":
+		session, _, _ = strings.Cut(args, ":")
+		if len(session) > base64.StdEncoding.EncodedLen(idSize) {
+			session = ""
+		}
+	}
+	userPokes := rl.limits.UserPokes
+	if r, ok := user.Attrs["rate"]; ok {
+		var err error
+		userPokes.Rate, err = strconv.ParseFloat(r, 64)
+		if err != nil || !(userPokes.Rate > 0) {
+			return false
+		}
+	}
+	now := rl.now()
+	if user.User != "" && !rl.userPokes.allow(user.User, userPokes, now) {
+		return false
+	}
+	return session == "" || rl.sessionPokes.allow(session, rl.limits.SessionPokes, now)
+}
+
+// allowExecute takes the execute tokens of starting backend work for user
+// from ip, in the session named session if not empty.
+func (rl *rateLimiter) allowExecute(ip net.IP, user *Identity, session string) bool {
+	now := rl.now()
+	if !rl.ipExecutes.allow(ip.String(), rl.limits.IPExecutes, now) {
+		return false
+	}
+	if user != nil && user.User != "" && !rl.userExecutes.allow(user.User, rl.limits.UserExecutes, now) {
+		return false
+	}
+	return session == "" || rl.sessionExecutes.allow(session, rl.limits.SessionExecutes, now)
+}
+
+func (rl *rateLimiter) reap() {
+	now := rl.now()
+	for _, ls := range []*limiterSet{
+		&rl.ipPokes, &rl.userPokes, &rl.sessionPokes,
+		&rl.ipExecutes, &rl.userExecutes, &rl.sessionExecutes,
+	} {
+		ls.reap(now)
+	}
+}
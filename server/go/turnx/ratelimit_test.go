@@ -0,0 +1,179 @@
+package turnx
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimiterSet(t *testing.T) {
+	var ls limiterSet
+	now := time.Now()
+	l := RateLimit{Rate: 2, Burst: 3}
+	for i := range 3 {
+		if !ls.allow("a", l, now) {
+			t.Fatalf("token %d of the burst denied", i)
+		}
+	}
+	if ls.allow("a", l, now) {
+		t.Error("token beyond the burst allowed")
+	}
+	if !ls.allow("b", l, now) {
+		t.Error("other key denied")
+	}
+	if !ls.allow("a", l, now.Add(500*time.Millisecond)) {
+		t.Error("refilled token denied")
+	}
+	for range 10 {
+		if !ls.allow("a", RateLimit{}, now) {
+			t.Fatal("zero RateLimit denied")
+		}
+	}
+
+	// a bucket is only forgotten once it has filled up again
+	ls.reap(now.Add(time.Second))
+	if _, ok := ls.limiters["a"]; !ok {
+		t.Error("draining bucket reaped")
+	}
+	ls.reap(now.Add(3 * time.Second))
+	if n := len(ls.limiters); n != 0 {
+		t.Errorf("%d limiters left after reaping", n)
+	}
+}
+
+func TestRateLimitUsers(t *testing.T) {
+	clock := newTestClock()
+	rl := &rateLimiter{
+		limits: RateLimits{
+			UserPokes:       RateLimit{Rate: 1, Burst: 2},
+			SessionExecutes: RateLimit{Rate: 1, Burst: 1},
+		},
+		now: clock.Now,
+	}
+	alice := &Identity{User: "alice"}
+	for _, tc := range []struct {
+		user *Identity
+		req  string
+		want bool
+	}{
+		{alice, "v:", true},
+		{alice, "e:AAAA", true},
+		{alice, "v:", false},
+		{&Identity{}, "v:", true},
+		{&Identity{User: "fast", Attrs: map[string]string{"rate": "100"}}, "v:", true},
+		{&Identity{User: "zero", Attrs: map[string]string{"rate": "0"}}, "v:", false},
+		{&Identity{User: "negative", Attrs: map[string]string{"rate": "-1"}}, "v:", false},
+		{&Identity{User: "invalid", Attrs: map[string]string{"rate": "fast"}}, "v:", false},
+	} {
+		if got := rl.allow(tc.user, tc.req); got != tc.want {
+			t.Errorf("%q %s: got %v, want %v", tc.user.User, tc.req, got, tc.want)
+		}
+	}
+
+	// a new rate applies to the bucket of the user at once
+	faster := &Identity{User: "alice", Attrs: map[string]string{"rate": "10"}}
+	if rl.allow(faster, "v:") {
+		t.Error("raised rate refilled the bucket")
+	}
+	clock.Advance(100 * time.Millisecond)
+	if !rl.allow(faster, "v:") {
+		t.Error("raised rate not applied")
+	}
+	if rl.allow(faster, "v:") {
+		t.Error("raised rate granted more than its refill")
+	}
+
+	ip := net.IPv4(127, 0, 0, 1)
+	if !rl.allowExecute(ip, alice, "AAAA") || rl.allowExecute(ip, alice, "AAAA") {
+		t.Error("session executes not limited")
+	}
+	if !rl.allowExecute(ip, nil, "") {
+		t.Error("execute without a session denied")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	clock := newTestClock()
+	srv := newTestServerWith(t, Options{
+		Backend: &HandlerBackend{Handler: echoHandler},
+		RateLimits: RateLimits{
+			IPPokes:    RateLimit{Rate: 20, Burst: 10},
+			IPExecutes: RateLimit{Rate: 0.01, Burst: 1},
+		},
+		now: clock.Now,
+	})
+	addr := serve(t, srv)
+	ctx := context.Background()
+	client := &Client{Addr: addr, Timeout: 200 * time.Millisecond}
+	req := []byte("GET /limited HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+	// only the first e: of a request takes an execute token
+	comped, err := codecZlib.compress(req, dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := client.Poke(ctx, fmt.Sprintf("s:%d", len(comped)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64id := base64.StdEncoding.EncodeToString(id)
+	if _, err := client.Poke(ctx, fmt.Sprintf("c:%s:0:%s", b64id, base64.StdEncoding.EncodeToString(comped))); err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		if _, err := client.Poke(ctx, "e:"+b64id); err != nil {
+			t.Fatalf("repeated e: %v", err)
+		}
+	}
+	// the clock stands still, so pokes beyond the burst stay limited
+	// until the client gives up
+	for range 20 {
+		if _, err = client.Poke(ctx, "v:"); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("got %v, want ErrRateLimited", err)
+	}
+	clock.Advance(time.Second)
+	if _, err := client.Poke(ctx, "v:"); err != nil {
+		t.Fatalf("after refill: %v", err)
+	}
+	// the second execute exceeds the execute limit
+	if _, err := client.Call(ctx, req); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("got %v, want ErrRateLimited", err)
+	}
+}
+
+func TestExecuteLimitBeforeDecompress(t *testing.T) {
+	srv := newTestServerWith(t, Options{
+		Backend:    &HandlerBackend{Handler: echoHandler},
+		RateLimits: RateLimits{IPExecutes: RateLimit{Rate: 0.01, Burst: 1}},
+		now:        newTestClock().Now,
+	})
+	ip := net.IPv4(127, 0, 0, 1)
+	garbage := []byte("not a compressed request")
+	upload := func() string {
+		t.Helper()
+		id, err := srv.turnpoke(ip, nil, fmt.Sprintf("s:%d", len(garbage)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b64id := base64.StdEncoding.EncodeToString(id)
+		if _, err := srv.turnpoke(ip, nil, fmt.Sprintf("c:%s:0:%s", b64id, base64.StdEncoding.EncodeToString(garbage))); err != nil {
+			t.Fatal(err)
+		}
+		return b64id
+	}
+	if _, err := srv.turnpoke(ip, nil, "e:"+upload()); err == nil || err == errRateLimited {
+		t.Fatalf("first e: got %v, want a decompression error", err)
+	}
+	// the token is gone, so the next request is not even decompressed
+	if _, err := srv.turnpoke(ip, nil, "e:"+upload()); err != errRateLimited {
+		t.Errorf("second e: got %v, want errRateLimited", err)
+	}
+}
@@ -0,0 +1,104 @@
+package turnx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Route sends the requests matching Host and PathPrefix to Backend. Paths
+// are compared as sent, without unescaping; requests whose path has dot
+// segments are refused rather than resolved.
+type Route struct {
+	// Name is matched against the "backend" attribute of users restricted
+	// to some routes.
+	Name string
+	// Host matches the Host header, without its port. Empty matches any.
+	Host string
+	// PathPrefix matches whole path segments: "/api" matches "/api" and
+	// "/api/users" but not "/apis". Empty matches any path.
+	PathPrefix string
+	// StripPrefix removes PathPrefix from the path before forwarding.
+	StripPrefix bool
+	Backend     Backend
+}
+
+// Router is a Backend that routes requests by Host header and path prefix.
+// Routes are tried in order; requests no route matches go to Default, or
+// get a 404 if it is nil. Users restricted to some routes get a 403 for the
+// others, and Default never serves them.
+type Router struct {
+	Routes  []Route
+	Default Backend
+}
+
+func (r *Route) match(host, path string) bool {
+	if r.Host != "" && !strings.EqualFold(r.Host, host) {
+		return false
+	}
+	prefix := strings.TrimSuffix(r.PathPrefix, "/")
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+func (b *Router) Execute(ctx context.Context, req []byte) ([]byte, error) {
+	httpReq, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(req)))
+	if err != nil {
+		return errorResponse(http.StatusBadRequest), nil
+	}
+	host := httpReq.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	path, _, _ := strings.Cut(httpReq.RequestURI, "?")
+	// backends resolve "/public/../admin" to "/admin", past the prefix
+	if hasDotSegment(path) {
+		return errorResponse(http.StatusBadRequest), nil
+	}
+	user, _ := UserFromContext(ctx)
+	for i := range b.Routes {
+		route := &b.Routes[i]
+		if !route.match(host, path) {
+			continue
+		}
+		if user != nil && !user.allows(route.Name) {
+			return errorResponse(http.StatusForbidden), nil
+		}
+		if route.StripPrefix {
+			req = stripPrefix(req, strings.TrimSuffix(route.PathPrefix, "/"))
+		}
+		return route.Backend.Execute(ctx, req)
+	}
+	if user != nil && user.restricted() {
+		return errorResponse(http.StatusForbidden), nil
+	}
+	if b.Default == nil {
+		return errorResponse(http.StatusNotFound), nil
+	}
+	return b.Default.Execute(ctx, req)
+}
+
+// hasDotSegment reports whether path has a "." or ".." segment, also when
+// percent-encoded.
+func hasDotSegment(path string) bool {
+	for _, seg := range strings.Split(path, "/") {
+		switch strings.ReplaceAll(strings.ToLower(seg), "%2e", ".") {
+		case ".", "..":
+			return true
+		}
+	}
+	return false
+}
+
+// stripPrefix removes prefix from the request target in the request line of
+// the raw request req, which is known to start with it.
+func stripPrefix(req []byte, prefix string) []byte {
+	method, rest, _ := bytes.Cut(req, []byte(" "))
+	target := rest[len(prefix):]
+	if len(target) == 0 || target[0] != '/' {
+		target = append([]byte("/"), target...)
+	}
+	return append(append(append([]byte{}, method...), ' '), target...)
+}
@@ -0,0 +1,118 @@
+package turnx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRouting(t *testing.T) {
+	remote := httptest.NewServer(echoHandler)
+	t.Cleanup(remote.Close)
+	target, err := url.Parse(remote.URL + "/base?k=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startServer(t, &Router{
+		Routes: []Route{
+			{Host: "api.example", Backend: &HTTPBackend{Target: target}},
+			{PathPrefix: "/static/", StripPrefix: true, Backend: &HandlerBackend{Handler: echoHandler}},
+		},
+	})
+	client := &Client{Addr: addr}
+	for _, tc := range []struct{ host, uri, want string }{
+		{"api.example:8080", "/users?id=2", "200 GET /base/users?k=1&id=2"},
+		{"localhost", "/static/a%2Fb?v=1", "200 GET /a%2Fb?v=1"},
+		{"localhost", "/static", "200 GET /"},
+		{"localhost", "/statics", "404 "},
+		{"api.example", "/../admin", "400 "},
+		{"localhost", "/static/../admin?v=1", "400 "},
+		{"localhost", "/static/%2e%2E/admin", "400 "},
+		{"localhost", "/static/./x", "400 "},
+		{"localhost", "/static/..x/.y", "200 GET /..x/.y"},
+	} {
+		req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", tc.uri, tc.host)
+		resp, err := client.Call(context.Background(), []byte(req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpResp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(resp)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(httpResp.Body)
+		line, _, _ := strings.Cut(string(body), "\n")
+		if httpResp.StatusCode != http.StatusOK {
+			line = ""
+		}
+		if got := fmt.Sprintf("%d %s", httpResp.StatusCode, line); got != tc.want {
+			t.Errorf("%s%s: got %q, want %q", tc.host, tc.uri, got, tc.want)
+		}
+	}
+}
+
+func TestRouteMatch(t *testing.T) {
+	for _, tc := range []struct {
+		route      Route
+		host, path string
+		want       bool
+	}{
+		{Route{}, "any", "/any", true},
+		{Route{Host: "API.example"}, "api.example", "/", true},
+		{Route{Host: "api.example"}, "www.example", "/", false},
+		{Route{PathPrefix: "/api"}, "", "/api", true},
+		{Route{PathPrefix: "/api"}, "", "/api/users", true},
+		{Route{PathPrefix: "/api/"}, "", "/api", true},
+		{Route{PathPrefix: "/api"}, "", "/apis", false},
+		{Route{PathPrefix: "/api"}, "", "/API", false},
+		{Route{PathPrefix: "/a%2Fb"}, "", "/a/b", false},
+		{Route{PathPrefix: "/"}, "", "/x", true},
+	} {
+		if got := tc.route.match(tc.host, tc.path); got != tc.want {
+			t.Errorf("%+v matching %s%s: got %v, want %v", tc.route, tc.host, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestHasDotSegment(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		want bool
+	}{
+		{"/", false},
+		{"/public/x", false},
+		{"/public/..x/x..", false},
+		{"/public/.hidden", false},
+		{"/public/../admin", true},
+		{"/public/..", true},
+		{"/public/./x", true},
+		{"/public/%2e%2e/admin", true},
+		{"/public/.%2E/admin", true},
+		{"/public/%2E/x", true},
+		{"..", true},
+	} {
+		if got := hasDotSegment(tc.path); got != tc.want {
+			t.Errorf("hasDotSegment(%q): got %v, want %v", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestStripPrefix(t *testing.T) {
+	for _, tc := range []struct{ req, prefix, want string }{
+		{"GET /api/users?id=1 HTTP/1.1\r\n", "/api", "GET /users?id=1 HTTP/1.1\r\n"},
+		{"GET /api HTTP/1.1\r\n", "/api", "GET / HTTP/1.1\r\n"},
+		{"GET /api?x HTTP/1.1\r\n", "/api", "GET /?x HTTP/1.1\r\n"},
+		{"DELETE /a/b/c HTTP/1.1\r\n\r\nbody", "/a/b", "DELETE /c HTTP/1.1\r\n\r\nbody"},
+	} {
+		if got := string(stripPrefix([]byte(tc.req), tc.prefix)); got != tc.want {
+			t.Errorf("stripPrefix(%q, %q): got %q, want %q", tc.req, tc.prefix, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,542 @@
+// Package turnx implements the turnrpc endpoint: a TURN-looking STUN server
+// that carries RPC requests in the USERNAME of Allocate requests and returns
+// the results encoded in the relayed address.
+package turnx
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"log"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/stun/v2"
+)
+
+type funcSetter func(m *stun.Message) error
+
+func (f funcSetter) AddTo(m *stun.Message) error {
+	return f(m)
+}
+
+const (
+	defaultPassword = "turnrpc"
+	defaultRealm    = "webrtcsocket.org"
+	defaultValidity = 30 * time.Second
+	defaultSoftware = "webrtcsocket"
+	defaultPrefix   = "turnrpc:"
+)
+
+// attrTurnrpc carries the turnrpc request when it is not in the USERNAME,
+// with no prefix. It is comprehension-optional, so other servers ignore it.
+const attrTurnrpc stun.AttrType = 0xC0DE
+
+// ErrServerClosed is returned by Serve after a call to Close.
+var ErrServerClosed = errors.New("turnx: Server closed")
+
+// Options configures a Server.
+type Options struct {
+	// Backend executes the requests sent with e:.
+	Backend Backend
+	// StreamBackend opens the backend connections of the stream sessions
+	// opened with o:. At least one of Backend and StreamBackend is required.
+	StreamBackend StreamBackend
+	// Realm is the TURN realm. Defaults to "webrtcsocket.org".
+	Realm string
+	// Auth authenticates requests. Defaults to SharedPassword(Password).
+	Auth Authenticator
+	// Password is the long-term credential shared by all clients when
+	// Auth is nil. Defaults to "turnrpc".
+	Password string
+	// Software is sent in the SOFTWARE attribute of responses. Defaults to
+	// "webrtcsocket".
+	Software string
+	// UsernamePrefix starts the USERNAME of every request; the rest is the
+	// turnrpc request. Defaults to "turnrpc:".
+	UsernamePrefix string
+	// NonceValidity is how long a NONCE is accepted, after which requests
+	// get a 438 Stale Nonce. Defaults to 10 minutes.
+	NonceValidity time.Duration
+	// NonceSecret keys the HMAC binding nonces to clients, so that servers
+	// sharing it accept each other's nonces. Defaults to a random key.
+	NonceSecret []byte
+	// Validity is how long a request may take from s: until the backend
+	// has answered, and how long the answer is then kept for e:, p: and r:.
+	// Defaults to 30 seconds.
+	Validity time.Duration
+	// MaxRequestSize bounds the compressed request announced with s:, in
+	// bytes. Defaults to 1 MiB.
+	MaxRequestSize int
+	// RateLimits bounds how fast clients may send requests. Defaults to
+	// unlimited.
+	RateLimits RateLimits
+	// Dictionaries lists the compression dictionaries requests may use,
+	// preferred first. Each request names its dictionary by the Adler-32
+	// DICTID in its zlib header, and the response is compressed with the
+	// same one. Defaults to DefaultDictionary alone.
+	Dictionaries [][]byte
+	// CacheSize bounds the compressed responses kept by a shared HTTP cache
+	// in front of the backend, in bytes. Zero disables the cache. Requests
+	// of authenticated users bypass it.
+	CacheSize int
+	// ErrorLog receives rejected requests and other errors.
+	// If nil, the log package's standard logger is used.
+	ErrorLog *log.Logger
+
+	// now is the clock of nonces, rate limits and mailboxes, time.Now if
+	// nil. Tests replace it.
+	now func() time.Time
+}
+
+// Server is a turnrpc server. Several Servers can run in one process.
+type Server struct {
+	backend       Backend
+	streamBackend StreamBackend
+	realm         string
+	auth          Authenticator
+	software      string
+	prefix        string
+	validity      time.Duration
+	maxReqSize    int
+	nonceKey      []byte
+	nonceValidity time.Duration
+	errorLog      *log.Logger
+	dicts         map[uint32][]byte
+	dictID        uint32
+	cache         *responseCache
+	limiter       *rateLimiter
+	now           func() time.Time
+
+	longReqValidUntils map[string]time.Time
+	longReqs           map[string][]byte
+	longReqCodecs      map[string]codec
+	longReqRanges      map[string]rangeSet
+	longStatuses       map[string]execStatus
+	longResps          map[string][]byte
+	mailboxes          map[string]*mailbox
+	streams            map[string]*streamSession
+	longReqLock        sync.Mutex
+
+	mu     sync.Mutex
+	conns  map[net.PacketConn]struct{}
+	closed bool
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewServer returns a Server configured by opts. The Server starts reaping
+// expired requests immediately; call Close to stop it.
+func NewServer(opts Options) (*Server, error) {
+	if opts.Backend == nil && opts.StreamBackend == nil {
+		return nil, errors.New("turnx: no backend")
+	}
+	if opts.Validity < 0 || opts.MaxRequestSize < 0 || opts.CacheSize < 0 || opts.NonceValidity < 0 {
+		return nil, errors.New("turnx: negative limit")
+	}
+	s := &Server{
+		backend:       opts.Backend,
+		streamBackend: opts.StreamBackend,
+		realm:         opts.Realm,
+		auth:          opts.Auth,
+		software:      opts.Software,
+		prefix:        opts.UsernamePrefix,
+		validity:      opts.Validity,
+		maxReqSize:    opts.MaxRequestSize,
+		nonceKey:      opts.NonceSecret,
+		nonceValidity: opts.NonceValidity,
+		errorLog:      opts.ErrorLog,
+		dicts:         make(map[uint32][]byte),
+		now:           opts.now,
+
+		longReqValidUntils: make(map[string]time.Time),
+		longReqs:           make(map[string][]byte),
+		longReqCodecs:      make(map[string]codec),
+		longReqRanges:      make(map[string]rangeSet),
+		longStatuses:       make(map[string]execStatus),
+		longResps:          make(map[string][]byte),
+		mailboxes:          make(map[string]*mailbox),
+		streams:            make(map[string]*streamSession),
+
+		conns: make(map[net.PacketConn]struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	if s.now == nil {
+		s.now = time.Now
+	}
+	s.limiter = &rateLimiter{limits: opts.RateLimits, now: s.now}
+	if s.realm == "" {
+		s.realm = defaultRealm
+	}
+	if s.auth == nil {
+		password := opts.Password
+		if password == "" {
+			password = defaultPassword
+		}
+		s.auth = SharedPassword(password)
+	}
+	if s.software == "" {
+		s.software = defaultSoftware
+	}
+	if s.prefix == "" {
+		s.prefix = defaultPrefix
+	}
+	if s.validity == 0 {
+		s.validity = defaultValidity
+	}
+	if s.maxReqSize == 0 {
+		s.maxReqSize = maxRequestSize
+	}
+	if s.nonceKey == nil {
+		s.nonceKey = make([]byte, 32)
+		rand.Read(s.nonceKey)
+	}
+	if s.nonceValidity == 0 {
+		s.nonceValidity = defaultNonceValidity
+	}
+	if s.errorLog == nil {
+		s.errorLog = log.Default()
+	}
+	dicts := opts.Dictionaries
+	if len(dicts) == 0 {
+		dicts = [][]byte{dict}
+	}
+	for i, d := range dicts {
+		id := adler32.Checksum(d)
+		if _, ok := s.dicts[id]; ok {
+			return nil, fmt.Errorf("turnx: dictionary %d duplicates DICTID %08x", i, id)
+		}
+		s.dicts[id] = bytes.Clone(d)
+	}
+	s.dictID = adler32.Checksum(dicts[0])
+	if opts.CacheSize > 0 {
+		s.cache = newResponseCache(opts.CacheSize)
+	}
+	go func() {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-t.C:
+				s.reapLong()
+				s.reapMailboxes()
+				s.limiter.reap()
+			}
+		}
+	}()
+	return s, nil
+}
+
+// Serve reads STUN messages from conn and answers them until conn fails or
+// the Server is closed. Serve always returns a non-nil error; after Close it
+// returns ErrServerClosed.
+func (s *Server) Serve(conn net.PacketConn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.ctx.Done():
+				return ErrServerClosed
+			default:
+				return err
+			}
+		}
+		s.serveMessage(conn, addr, buf[:n])
+	}
+}
+
+// serveMessage decodes and answers a single datagram. A panic while handling
+// it is logged instead of taking down the Serve loop.
+func (s *Server) serveMessage(conn net.PacketConn, addr net.Addr, raw []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.errorLog.Printf("turnx: panic serving %v: %v\n%s", addr, r, debug.Stack())
+		}
+	}()
+	msg := stun.Message{}
+	err := stun.Decode(raw, &msg)
+	if err != nil {
+		return
+	}
+
+	s.handleRequest(conn, addr, &msg)
+}
+
+// Close stops the Server and closes every connection passed to Serve.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.cancel()
+	s.longReqLock.Lock()
+	for id, st := range s.streams {
+		st.close()
+		delete(s.streams, id)
+	}
+	s.longReqLock.Unlock()
+	var err error
+	for conn := range s.conns {
+		if cerr := conn.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// addrIPPort returns the IP and port of a peer address, whatever the
+// concrete net.Addr of the PacketConn is.
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.IP, udpAddr.Port
+	}
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return net.IPv4zero, 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ip = net.IPv4zero
+	}
+	return ip, port
+}
+
+// genErrorResponse answers msg from ip with an error and a fresh NONCE to
+// authenticate again with.
+func (s *Server) genErrorResponse(msg *stun.Message, ip net.IP, code stun.ErrorCode, reason string) *stun.Message {
+	return stun.MustBuild(
+		stun.NewTransactionIDSetter(msg.TransactionID),
+		stun.NewType(msg.Type.Method, stun.ClassErrorResponse),
+		stun.ErrorCodeAttribute{
+			Code:   code,
+			Reason: []byte(reason),
+		},
+		stun.NewNonce(s.newNonce(ip)),
+		stun.Realm([]byte(s.realm)),
+		stun.Software([]byte(s.software)),
+	)
+}
+
+func (s *Server) genUnauthResponse(msg *stun.Message, ip net.IP) *stun.Message {
+	return s.genErrorResponse(msg, ip, stun.CodeUnauthorized, "Unauthorized")
+}
+
+// genLimitedResponse answers a request exceeding the RateLimits.
+func (s *Server) genLimitedResponse(msg *stun.Message, ip net.IP) *stun.Message {
+	return s.genErrorResponse(msg, ip, stun.CodeAllocQuotaReached, "Rate Limited")
+}
+
+// errStaleNonce is returned by checkAuth for requests whose NONCE has expired
+// or was not issued to their sender. As in RFC 8489 section 9.2.4, the NONCE
+// is checked before the credentials.
+var errStaleNonce = errors.New("Stale nonce")
+
+// checkAuth authenticates msg from ip and returns its USERNAME, who sent it
+// and the turnrpc request it carries.
+func (s *Server) checkAuth(msg *stun.Message, ip net.IP) (username string, id *Identity, req string, err error) {
+	requiredAttrs := []stun.AttrType{
+		stun.AttrUsername,
+		stun.AttrNonce,
+		stun.AttrRealm,
+		stun.AttrMessageIntegrity,
+	}
+	for _, attr := range requiredAttrs {
+		if _, ok := msg.Attributes.Get(attr); !ok {
+			return "", nil, "", errors.New("No authentication factor " + attr.String())
+		}
+	}
+	// MESSAGE-INTEGRITY only covers the attributes before it, so only
+	// FINGERPRINT may follow it and TURNRPC is only taken from before it.
+	var reqAttr *stun.RawAttribute
+	protected := true
+	for i, attr := range msg.Attributes {
+		switch {
+		case !protected:
+			if attr.Type != stun.AttrFingerprint {
+				return "", nil, "", errors.New("Unprotected attribute " + attr.Type.String())
+			}
+		case attr.Type == stun.AttrMessageIntegrity:
+			protected = false
+		case attr.Type == attrTurnrpc && reqAttr == nil:
+			reqAttr = &msg.Attributes[i]
+		}
+	}
+	nonceAttr, _ := msg.Attributes.Get(stun.AttrNonce)
+	if !s.checkNonce(nonceAttr.Value, ip) {
+		return "", nil, "", errStaleNonce
+	}
+	usernameAttr, _ := msg.Attributes.Get(stun.AttrUsername)
+	username = string(usernameAttr.Value)
+	id, err = s.auth.Authenticate(username)
+	if err != nil {
+		return "", nil, "", err
+	}
+	if reqAttr != nil {
+		req = string(reqAttr.Value)
+	} else if strings.HasPrefix(id.Request, s.prefix) {
+		req = id.Request[len(s.prefix):]
+	} else {
+		return "", nil, "", errors.New("Invalid username")
+	}
+	err = msg.Check(id.integrity(username, s.realm))
+	if err != nil {
+		return "", nil, "", err
+	}
+	return username, id, req, nil
+}
+
+func (s *Server) handleRequest(conn net.PacketConn, addr net.Addr, msg *stun.Message) {
+	ip, port := addrIPPort(addr)
+	switch msg.Type.Class {
+	case stun.ClassRequest:
+		switch msg.Type.Method {
+		case stun.MethodBinding:
+			response := stun.MustBuild(
+				stun.NewTransactionIDSetter(msg.TransactionID),
+				stun.BindingSuccess,
+				stun.XORMappedAddress{
+					IP:   ip,
+					Port: port,
+				},
+			)
+			conn.WriteTo(response.Raw, addr)
+		case stun.MethodAllocate:
+			if !s.limiter.allowIP(ip) {
+				conn.WriteTo(s.genLimitedResponse(msg, ip).Raw, addr)
+				return
+			}
+			username, id, req, err := s.checkAuth(msg, ip)
+			if err == errStaleNonce {
+				conn.WriteTo(s.genErrorResponse(msg, ip, stun.CodeStaleNonce, "Stale Nonce").Raw, addr)
+				return
+			}
+			if err != nil {
+				s.errorLog.Println(err)
+				conn.WriteTo(s.genUnauthResponse(msg, ip).Raw, addr)
+				return
+			}
+			if !s.limiter.allow(id, req) {
+				conn.WriteTo(s.genLimitedResponse(msg, ip).Raw, addr)
+				return
+			}
+			payload, err := s.turnpoke(ip, id, req)
+			if err == errRateLimited {
+				conn.WriteTo(s.genLimitedResponse(msg, ip).Raw, addr)
+				return
+			}
+			if err != nil {
+				s.errorLog.Println(err)
+				conn.WriteTo(s.genUnauthResponse(msg, ip).Raw, addr)
+				return
+			}
+			payload_len := len(payload)
+			if len(payload) > 16 {
+				payload = payload[:16]
+				payload_len = 16
+			} else if len(payload) < 16 {
+				payload = append(payload, make([]byte, 16-len(payload))...)
+			}
+			ipBytes := append([]byte{0xfc}, payload[1:]...)
+			topByte := payload[0]
+			relayedPort := 0xc000 | (payload_len << 8) | int(topByte)
+			response := stun.MustBuild(
+				stun.NewTransactionIDSetter(msg.TransactionID),
+				stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse),
+				funcSetter(func(m *stun.Message) error {
+					tmp := stun.XORMappedAddress{
+						IP:   ipBytes,
+						Port: relayedPort,
+					}
+					return tmp.AddToAs(m, stun.AttrXORRelayedAddress)
+				}),
+				stun.RawAttribute{
+					Type:  stun.AttrLifetime,
+					Value: []byte{0xef, 0xff, 0xff, 0xff},
+				},
+				stun.XORMappedAddress{
+					IP:   ip,
+					Port: port,
+				},
+				stun.Realm([]byte(s.realm)),
+				stun.Software([]byte(s.software)),
+				id.integrity(username, s.realm),
+			)
+			conn.WriteTo(response.Raw, addr)
+		case stun.MethodRefresh:
+			if !s.limiter.allowIP(ip) {
+				conn.WriteTo(s.genLimitedResponse(msg, ip).Raw, addr)
+				return
+			}
+			username, id, _, err := s.checkAuth(msg, ip)
+			if err == errStaleNonce {
+				conn.WriteTo(s.genErrorResponse(msg, ip, stun.CodeStaleNonce, "Stale Nonce").Raw, addr)
+				return
+			}
+			if err != nil {
+				conn.WriteTo(s.genUnauthResponse(msg, ip).Raw, addr)
+				return
+			}
+			lifetime, ok := msg.Attributes.Get(stun.AttrLifetime)
+			isDealloc := true
+			if ok {
+				for _, v := range lifetime.Value {
+					if v != 0 {
+						isDealloc = false
+						break
+					}
+				}
+			} else {
+				isDealloc = false
+			}
+			if isDealloc {
+				response := stun.MustBuild(
+					stun.NewTransactionIDSetter(msg.TransactionID),
+					stun.NewType(stun.MethodRefresh, stun.ClassSuccessResponse),
+					stun.RawAttribute{
+						Type:  stun.AttrLifetime,
+						Value: []byte{0x00, 0x00, 0x00, 0x00},
+					},
+					id.integrity(username, s.realm),
+				)
+				conn.WriteTo(response.Raw, addr)
+			} else {
+				response := stun.MustBuild(
+					stun.NewTransactionIDSetter(msg.TransactionID),
+					stun.NewType(stun.MethodRefresh, stun.ClassErrorResponse),
+					stun.ErrorCodeAttribute{
+						Code:   stun.CodeInsufficientCapacity,
+						Reason: []byte("Insufficient Capacity"),
+					},
+					id.integrity(username, s.realm),
+				)
+				conn.WriteTo(response.Raw, addr)
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package turnx
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/stun/v2"
+)
+
+func newTestServer(t testing.TB, backend Backend) *Server {
+	t.Helper()
+	return newTestServerWith(t, Options{Backend: backend, Validity: time.Hour})
+}
+
+// testNonceKey lets tests build requests carrying a valid NONCE.
+var testNonceKey = []byte("test nonce key")
+
+// newTestServerWith is newTestServer with further options.
+func newTestServerWith(t testing.TB, opts Options) *Server {
+	t.Helper()
+	opts.ErrorLog = log.New(io.Discard, "", 0)
+	if opts.NonceSecret == nil {
+		opts.NonceSecret = testNonceKey
+	}
+	srv, err := NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+// discardConn is a PacketConn that drops every reply.
+type discardConn struct {
+	net.PacketConn
+}
+
+func (discardConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return len(p), nil
+}
+
+// testClock is a clock that only moves when advanced.
+type testClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{t: time.Now()}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func compressed(t testing.TB, data string) []byte {
+	t.Helper()
+	w := &bytes.Buffer{}
+	z, err := zlib.NewWriterLevelDict(w, zlib.BestCompression, dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.Write([]byte(data))
+	z.Close()
+	return w.Bytes()
+}
+
+func buildRequest(t testing.TB, method stun.Method, req string, setters ...stun.Setter) []byte {
+	t.Helper()
+	username := defaultPrefix + req
+	setters = append([]stun.Setter{
+		stun.TransactionID,
+		stun.NewType(method, stun.ClassRequest),
+		stun.NewUsername(username),
+		stun.NewRealm(defaultRealm),
+		stun.NewNonce(makeNonce(testNonceKey, net.IPv4(127, 0, 0, 1), time.Now())),
+	}, setters...)
+	setters = append(setters, stun.NewLongTermIntegrity(username, defaultRealm, defaultPassword))
+	m, err := stun.Build(setters...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.Raw
+}
+
+func TestCheckAuthAttributeOrder(t *testing.T) {
+	s := newTestServer(t, &HandlerBackend{Handler: echoHandler})
+	ip := net.IPv4(127, 0, 0, 1)
+	turnrpc := func(req string) stun.RawAttribute {
+		return stun.RawAttribute{Type: attrTurnrpc, Value: []byte(req)}
+	}
+	decode := func(raw []byte) *stun.Message {
+		t.Helper()
+		msg := &stun.Message{}
+		if err := stun.Decode(raw, msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	// TURNRPC before MESSAGE-INTEGRITY replaces the request of the USERNAME
+	msg := decode(buildRequest(t, stun.MethodAllocate, "v:", turnrpc("s:8")))
+	if err := stun.Fingerprint.AddTo(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, req, err := s.checkAuth(msg, ip); err != nil || req != "s:8" {
+		t.Errorf("got %q, %v, want %q", req, err, "s:8")
+	}
+
+	// anything but FINGERPRINT after it is not covered by the integrity
+	for _, add := range []stun.Setter{turnrpc("s:8"), stun.NewSoftware("x")} {
+		msg := decode(buildRequest(t, stun.MethodAllocate, "v:"))
+		if err := add.AddTo(msg); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, req, err := s.checkAuth(msg, ip); err == nil {
+			t.Errorf("%v after MESSAGE-INTEGRITY accepted as %q", add, req)
+		}
+	}
+}
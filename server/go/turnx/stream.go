@@ -0,0 +1,391 @@
+package turnx
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StreamBackend opens the backend connections of stream sessions. A stream
+// session is opened with o: and lives until x: or until it has not been
+// poked for the validity period. Offsets are 31-bit, so a session carries
+// at most 2 GiB each way: larger uploads are refused, and the session is
+// closed once the backend has sent that much.
+type StreamBackend interface {
+	Open(ctx context.Context) (Stream, error)
+}
+
+// datagramBackend is implemented by StreamBackends whose streams send the
+// content of every w: as a datagram of its own. v: reports it, so that
+// clients do not split a write across several w:.
+type datagramBackend interface {
+	StreamBackend
+	datagrams()
+}
+
+// Stream is a backend connection kept across pokes.
+type Stream interface {
+	// Send delivers the content of one w:, in upload order. It is not
+	// called concurrently.
+	Send(p []byte) error
+	// Receive blocks until the backend sends data, which is appended to
+	// what the client reads with r:. It returns an error once the stream
+	// has ended.
+	Receive() ([]byte, error)
+	// Close ends the stream and unblocks Send and Receive.
+	Close() error
+}
+
+const (
+	// maxStreamWindow bounds how far beyond the delivered upload a w: may
+	// write.
+	maxStreamWindow = 64 << 10
+	// maxStreamBuffer bounds the downstream data waiting to be
+	// acknowledged with p:. The backend is not read from while it is full.
+	maxStreamBuffer = 1 << 20
+	// maxPendingChunks bounds the chunks received out of order.
+	maxPendingChunks = 256
+	// maxStreamOffset is the largest offset parseOffset accepts.
+	maxStreamOffset = 1<<31 - 1
+	// maxStreams bounds the open stream sessions, and maxUserStreams those
+	// of each authenticated user.
+	maxStreams     = 1024
+	maxUserStreams = 16
+)
+
+// streamSession is the state of a stream session, guarded by longReqLock.
+type streamSession struct {
+	stream Stream // nil while opening
+	user   string
+	cancel context.CancelFunc
+	done   chan struct{} // closed by close
+	closed bool
+
+	// upload
+	next    int           // offset of the next byte to deliver
+	pending []streamChunk // received beyond next, sorted and disjoint
+	outq    [][]byte      // chunks to deliver, in order
+	wake    chan struct{}
+
+	// download
+	base  int // offset of down[0]
+	down  []byte
+	space *sync.Cond // signalled when down shrinks or the session closes
+}
+
+// streamChunk is upload data received beyond the delivered offset.
+type streamChunk struct {
+	offset int
+	data   []byte
+}
+
+func (c streamChunk) end() int {
+	return c.offset + len(c.data)
+}
+
+// write adds the content of a w: at offset to the upload and queues what
+// has become contiguous for delivery. Every w: stays a chunk of its own, as
+// Send delivers the content of one w:. A retransmitted chunk is dropped, and
+// content overlapping other chunks is refused.
+func (st *streamSession) write(offset int, content []byte) error {
+	end := offset + len(content)
+	if end <= st.next {
+		return nil
+	}
+	if offset < st.next {
+		return errors.New("Overlapping chunk")
+	}
+	i := 0
+	for i < len(st.pending) && st.pending[i].end() <= offset {
+		i++
+	}
+	if i < len(st.pending) && st.pending[i].offset < end {
+		if c := st.pending[i]; c.offset == offset && bytes.Equal(c.data, content) {
+			return nil
+		}
+		return errors.New("Overlapping chunk")
+	}
+	if offset > st.next && len(st.pending) >= maxPendingChunks {
+		return errors.New("Too many pending chunks")
+	}
+	pending := append(st.pending[:i:i], streamChunk{offset, content})
+	st.pending = append(pending, st.pending[i:]...)
+	for len(st.pending) > 0 && st.pending[0].offset == st.next {
+		st.outq = append(st.outq, st.pending[0].data)
+		st.next = st.pending[0].end()
+		st.pending = st.pending[1:]
+	}
+	return nil
+}
+
+// close ends the session. The lock must be held.
+func (st *streamSession) close() {
+	if st.closed {
+		return
+	}
+	st.closed = true
+	close(st.done)
+	st.cancel()
+	if st.stream != nil {
+		st.stream.Close()
+	}
+	st.space.Broadcast()
+}
+
+// statusReply returns the reply of p: for the session: its status followed
+// by the end offset of the downstream data.
+func (st *streamSession) statusReply() []byte {
+	status := statusStreaming
+	switch {
+	case st.stream == nil && !st.closed:
+		status = statusPending
+	case st.closed:
+		status = statusClosed
+	}
+	return binary.BigEndian.AppendUint32([]byte{byte(status)}, uint32(st.base+len(st.down)))
+}
+
+// openStream starts a stream session of user from ip and returns its id.
+// The lock must be held.
+func (s *Server) openStream(ip net.IP, user *Identity) ([]byte, error) {
+	if len(s.streams) >= maxStreams {
+		return nil, errors.New("Too many streams")
+	}
+	st := &streamSession{
+		done:  make(chan struct{}),
+		wake:  make(chan struct{}, 1),
+		space: sync.NewCond(&s.longReqLock),
+	}
+	if user != nil && user.User != "" {
+		st.user = user.User
+		n := 0
+		for _, other := range s.streams {
+			if other.user == st.user {
+				n++
+			}
+		}
+		if n >= maxUserStreams {
+			return nil, errors.New("Too many streams")
+		}
+	}
+	if !s.limiter.allowExecute(ip, user, "") {
+		return nil, errRateLimited
+	}
+	id := make([]byte, idSize)
+	rand.Read(id)
+	var ctx context.Context
+	ctx, st.cancel = context.WithCancel(withUser(s.ctx, user))
+	s.streams[string(id)] = st
+	s.longReqValidUntils[string(id)] = time.Now().Add(s.validity)
+	go s.runStream(ctx, st)
+	return id, nil
+}
+
+// runStream opens the backend connection of st, then delivers its upload.
+func (s *Server) runStream(ctx context.Context, st *streamSession) {
+	stream, err := s.openBackendStream(ctx)
+	s.longReqLock.Lock()
+	if err != nil {
+		s.errorLog.Println(err)
+		st.close()
+		s.longReqLock.Unlock()
+		return
+	}
+	if st.closed {
+		s.longReqLock.Unlock()
+		stream.Close()
+		return
+	}
+	st.stream = stream
+	s.longReqLock.Unlock()
+	go s.receiveStream(st)
+
+	for {
+		select {
+		case <-st.wake:
+		case <-st.done:
+			return
+		}
+		s.longReqLock.Lock()
+		outq := st.outq
+		st.outq = nil
+		s.longReqLock.Unlock()
+		for _, p := range outq {
+			if err := s.sendStream(stream, p); err != nil {
+				s.longReqLock.Lock()
+				st.close()
+				s.longReqLock.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// openBackendStream, sendStream and receiveFrom turn a panicking backend
+// into an error, like callBackend.
+func (s *Server) openBackendStream(ctx context.Context) (stream Stream, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Backend panic: %v", r)
+		}
+	}()
+	return s.streamBackend.Open(ctx)
+}
+
+func (s *Server) sendStream(stream Stream, p []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Backend panic: %v", r)
+			s.errorLog.Println(err)
+		}
+	}()
+	return stream.Send(p)
+}
+
+func (s *Server) receiveFrom(stream Stream) (p []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Backend panic: %v", r)
+			s.errorLog.Println(err)
+		}
+	}()
+	return stream.Receive()
+}
+
+// receiveStream buffers what the backend sends until the session closes.
+func (s *Server) receiveStream(st *streamSession) {
+	for {
+		p, err := s.receiveFrom(st.stream)
+		s.longReqLock.Lock()
+		if err == nil && st.base+len(st.down)+len(p) > maxStreamOffset {
+			err = errors.New("Stream too long")
+		}
+		if err != nil {
+			st.close()
+			s.longReqLock.Unlock()
+			return
+		}
+		for len(st.down) > 0 && len(st.down)+len(p) > maxStreamBuffer && !st.closed {
+			st.space.Wait()
+		}
+		st.down = append(st.down, p...)
+		closed := st.closed
+		s.longReqLock.Unlock()
+		if closed {
+			return
+		}
+	}
+}
+
+// streamPoke runs the turnrpc requests of stream sessions: o:, w:, x:, and p:
+// and r: for the ids of stream sessions. The lock must be held.
+func (s *Server) streamPoke(ip net.IP, user *Identity, method, args string) ([]byte, error) {
+	if s.streamBackend == nil {
+		return nil, errors.New("Unknown method")
+	}
+	if method == "o" { // open a stream session
+		if args != "" {
+			return nil, errors.New("Invalid request")
+		}
+		return s.openStream(ip, user)
+	}
+	parts := strings.SplitN(args, ":", 3)
+	id, err := parseID(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	st, ok := s.streams[id]
+	if !ok {
+		return nil, errors.New("Unknown request")
+	}
+	s.longReqValidUntils[id] = time.Now().Add(s.validity)
+	switch method {
+	case "w": // upload content at an offset of the stream, replies with the delivered offset
+		if len(parts) != 3 {
+			return nil, errors.New("Invalid request")
+		}
+		offset, err := parseOffset(parts[1], st.next+maxStreamWindow)
+		if err != nil {
+			return nil, err
+		}
+		if base64.StdEncoding.DecodedLen(len(parts[2])) > maxChunkSize {
+			return nil, errors.New("Content too long")
+		}
+		content, err := base64.StdEncoding.Strict().DecodeString(parts[2])
+		if err != nil {
+			return nil, err
+		}
+		end := offset + len(content)
+		if len(content) == 0 || end > st.next+maxStreamWindow || end > maxStreamOffset {
+			return nil, errors.New("Invalid request")
+		}
+		if st.closed {
+			return nil, errors.New("Stream closed")
+		}
+		if err := st.write(offset, content); err != nil {
+			return nil, err
+		}
+		select {
+		case st.wake <- struct{}{}:
+		default:
+		}
+		return binary.BigEndian.AppendUint32(nil, uint32(st.next)), nil
+	case "p": // poll the stream, optionally acknowledging what was read
+		if len(parts) == 3 {
+			return nil, errors.New("Invalid request")
+		}
+		if len(parts) == 2 {
+			ack, err := parseOffset(parts[1], st.base+len(st.down))
+			if err != nil {
+				return nil, err
+			}
+			if ack > st.base {
+				st.down = append([]byte(nil), st.down[ack-st.base:]...)
+				st.base = ack
+				st.space.Broadcast()
+			}
+		}
+		return st.statusReply(), nil
+	case "r": // read the stream from an offset
+		if len(parts) != 2 {
+			return nil, errors.New("Invalid request")
+		}
+		offset, err := parseOffset(parts[1], st.base+len(st.down))
+		if err != nil {
+			return nil, err
+		}
+		if offset < st.base {
+			return nil, errors.New("Offset acknowledged")
+		}
+		out := st.down[offset-st.base:]
+		return out[:min(len(out), 16)], nil
+	case "x": // close the stream session
+		if len(parts) != 1 {
+			return nil, errors.New("Invalid request")
+		}
+		st.close()
+		delete(s.streams, id)
+		delete(s.longReqValidUntils, id)
+		return nil, nil
+	}
+	return nil, errors.New("Unknown method")
+}
+
+// isStream reports whether the first field of args names a stream session.
+func (s *Server) isStream(args string) bool {
+	idStr, _, _ := strings.Cut(args, ":")
+	id, err := parseID(idStr)
+	if err != nil {
+		return false
+	}
+	_, ok := s.streams[id]
+	return ok
+}
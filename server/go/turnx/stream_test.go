@@ -0,0 +1,198 @@
+package turnx
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// echoStreamBackend opens streams that send back what they receive. They
+// panic in Send on "panic" and in Receive on "boom".
+type echoStreamBackend struct{}
+
+func (echoStreamBackend) Open(ctx context.Context) (Stream, error) {
+	return &echoStream{ch: make(chan []byte, 16), done: make(chan struct{})}, nil
+}
+
+type echoStream struct {
+	ch   chan []byte
+	done chan struct{}
+	once sync.Once
+}
+
+func (e *echoStream) Send(p []byte) error {
+	if string(p) == "panic" {
+		panic("send")
+	}
+	select {
+	case e.ch <- p:
+		return nil
+	case <-e.done:
+		return io.ErrClosedPipe
+	}
+}
+
+func (e *echoStream) Receive() ([]byte, error) {
+	select {
+	case p := <-e.ch:
+		if string(p) == "boom" {
+			panic("receive")
+		}
+		return p, nil
+	case <-e.done:
+		return nil, io.EOF
+	}
+}
+
+func (e *echoStream) Close() error {
+	e.once.Do(func() { close(e.done) })
+	return nil
+}
+
+func TestStreamWrite(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+	for _, tc := range []struct {
+		name   string
+		writes []span
+		chunks []int // lengths of the delivered chunks
+		err    bool
+	}{
+		{"in order", []span{{0, 4}, {4, 10}}, []int{4, 6}, false},
+		{"out of order", []span{{4, 8}, {8, 10}, {0, 4}}, []int{4, 4, 2}, false},
+		{"retransmitted", []span{{0, 4}, {0, 4}, {4, 6}, {0, 2}}, []int{4, 2}, false},
+		{"retransmitted pending", []span{{4, 6}, {4, 6}, {0, 4}}, []int{4, 2}, false},
+		{"gap", []span{{0, 4}, {6, 8}}, []int{4}, false},
+		{"starting inside received data", []span{{0, 6}, {4, 10}}, []int{6}, true},
+		{"overlapping pending", []span{{6, 10}, {8, 14}}, nil, true},
+		{"longer at a pending offset", []span{{6, 8}, {6, 10}}, nil, true},
+	} {
+		st := &streamSession{}
+		var err error
+		for _, w := range tc.writes {
+			if err = st.write(w.start, data[w.start:w.end]); err != nil {
+				break
+			}
+		}
+		if (err != nil) != tc.err {
+			t.Errorf("%s: got %v, want error %v", tc.name, err, tc.err)
+		}
+		var chunks []int
+		for _, c := range st.outq {
+			chunks = append(chunks, len(c))
+		}
+		if got := slices.Concat(st.outq...); !slices.Equal(chunks, tc.chunks) || string(got) != string(data[:st.next]) {
+			t.Errorf("%s: delivered %q in chunks %v, want chunks %v", tc.name, got, chunks, tc.chunks)
+		}
+	}
+
+	// chunks that end up contiguous are still delivered one by one
+	st := &streamSession{}
+	for _, w := range []struct {
+		offset  int
+		content string
+	}{{100, "CC"}, {102, "DD"}, {0, string(make([]byte, 100))}} {
+		if err := st.write(w.offset, []byte(w.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(st.outq) != 3 || len(st.outq[0]) != 100 || string(st.outq[1]) != "CC" || string(st.outq[2]) != "DD" {
+		t.Errorf("got chunks %q", st.outq)
+	}
+
+	// disjoint chunks are bounded, but the next one is always accepted
+	st = &streamSession{}
+	for i := range maxPendingChunks {
+		if err := st.write(2*i+2, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.write(2*maxPendingChunks+2, []byte("x")); err == nil {
+		t.Error("chunk beyond maxPendingChunks accepted")
+	}
+	if err := st.write(0, []byte("xx")); err != nil || st.next != 3 {
+		t.Errorf("next chunk: got %v, next %d", err, st.next)
+	}
+}
+
+func TestStreamLimits(t *testing.T) {
+	s := newTestServerWith(t, Options{StreamBackend: echoStreamBackend{}, Validity: time.Hour})
+	alice := &Identity{User: "alice"}
+	for range maxUserStreams {
+		if _, err := s.turnpoke(nil, alice, "o:"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.turnpoke(nil, alice, "o:"); err == nil {
+		t.Error("stream beyond maxUserStreams opened")
+	}
+	if _, err := s.turnpoke(nil, &Identity{User: "bob"}, "o:"); err != nil {
+		t.Errorf("other user: %v", err)
+	}
+	for len(s.streams) < maxStreams {
+		if _, err := s.turnpoke(nil, nil, "o:"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.turnpoke(nil, nil, "o:"); err == nil {
+		t.Error("stream beyond maxStreams opened")
+	}
+}
+
+func TestStreamPanic(t *testing.T) {
+	s := newTestServerWith(t, Options{StreamBackend: echoStreamBackend{}, Validity: time.Hour})
+	for _, msg := range []string{"panic", "boom"} {
+		id, err := s.turnpoke(nil, nil, "o:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b64id := base64.StdEncoding.EncodeToString(id)
+		content := base64.StdEncoding.EncodeToString([]byte(msg))
+		if _, err := s.turnpoke(nil, nil, "w:"+b64id+":0:"+content); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			status, err := s.turnpoke(nil, nil, "p:"+b64id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if execStatus(status[0]) == statusClosed {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: session still open", msg)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestStreamOffsets(t *testing.T) {
+	s := newTestServerWith(t, Options{StreamBackend: echoStreamBackend{}, Validity: time.Hour})
+	id, err := s.turnpoke(nil, nil, "o:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64id := base64.StdEncoding.EncodeToString(id)
+	s.longReqLock.Lock()
+	st := s.streams[string(id)]
+	st.next = maxStreamOffset - 2
+	s.longReqLock.Unlock()
+	for _, tc := range []struct {
+		content string
+		ok      bool
+	}{
+		{"abcd", false},
+		{"ab", true},
+	} {
+		req := "w:" + b64id + ":" + strconv.Itoa(maxStreamOffset-2) + ":" + base64.StdEncoding.EncodeToString([]byte(tc.content))
+		if _, err := s.turnpoke(nil, nil, req); (err == nil) != tc.ok {
+			t.Errorf("%q at the end of the offsets: got %v", tc.content, err)
+		}
+	}
+}
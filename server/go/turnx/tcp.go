@@ -0,0 +1,53 @@
+package turnx
+
+import (
+	"context"
+	"net"
+)
+
+// tcpReadSize is the most a TCP stream reads at once.
+const tcpReadSize = 16 << 10
+
+// TCPBackend is a StreamBackend that connects to Addr over TCP for every
+// stream session. The session carries the raw byte stream in both
+// directions.
+type TCPBackend struct {
+	// Addr is the host:port to connect to.
+	Addr string
+	// Dialer defaults to a zero net.Dialer.
+	Dialer *net.Dialer
+}
+
+func (b *TCPBackend) Open(ctx context.Context) (Stream, error) {
+	dialer := b.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", b.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return &tcpStream{conn: conn}, nil
+}
+
+type tcpStream struct {
+	conn net.Conn
+}
+
+func (t *tcpStream) Send(p []byte) error {
+	_, err := t.conn.Write(p)
+	return err
+}
+
+func (t *tcpStream) Receive() ([]byte, error) {
+	buf := make([]byte, tcpReadSize)
+	n, err := t.conn.Read(buf)
+	if n > 0 {
+		return buf[:n], nil
+	}
+	return nil, err
+}
+
+func (t *tcpStream) Close() error {
+	return t.conn.Close()
+}
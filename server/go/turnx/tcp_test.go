@@ -0,0 +1,54 @@
+package turnx
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPStream(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// answer with the upper-cased input, then hang up
+			go func() {
+				defer conn.Close()
+				buf, _ := io.ReadAll(io.LimitReader(conn, 5000))
+				conn.Write(bytes.ToUpper(buf))
+			}()
+		}
+	}()
+	addr := serve(t, newTestServerWith(t, Options{
+		StreamBackend: &TCPBackend{Addr: l.Addr().String()},
+		Validity:      time.Hour,
+	}))
+	client := &Client{Addr: addr}
+	tunnel, err := client.Open(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	input := bytes.Repeat([]byte("ping "), 1000)
+	if _, err := tunnel.Write(input); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(tunnel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := bytes.ToUpper(input); !bytes.Equal(got, want) {
+		t.Errorf("got %d bytes, want %d", len(got), len(want))
+	}
+}
@@ -0,0 +1,99 @@
+package turnx
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Transport is an http.RoundTripper for turnx://host:port/path URLs. The
+// request is sent as plain HTTP/1.1 through the turnx server at host:port,
+// like fetch() in client/src/turnx.ts. It can be used directly as an
+// http.Client's Transport, or registered on another transport with
+// RegisterProtocol("turnx", &turnx.Transport{}).
+type Transport struct {
+	// NewClient returns the Client for the turnx server at addr, with the
+	// credentials, codec, dictionary and other options to call it with. It
+	// is called once per address; the Client is then reused, as it learns
+	// the nonce and capabilities of its server. Defaults to a Client with
+	// the default options.
+	NewClient func(addr string) (*Client, error)
+
+	mu      sync.Mutex
+	clients map[string]*Client
+}
+
+// hopHeaders are not forwarded, as in serializeHTTP in client/src/http.ts.
+var hopHeaders = []string{
+	"Connection",
+	"Upgrade",
+	"Keep-Alive",
+}
+
+func (t *Transport) client(addr string) (*Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c := t.clients[addr]; c != nil {
+		return c, nil
+	}
+	c := &Client{Addr: addr}
+	if t.NewClient != nil {
+		var err error
+		if c, err = t.NewClient(addr); err != nil {
+			return nil, err
+		}
+	}
+	if t.clients == nil {
+		t.clients = make(map[string]*Client)
+	}
+	t.clients[addr] = c
+	return c, nil
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "turnx" {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, errors.New("turnx: unsupported protocol scheme " + req.URL.Scheme)
+	}
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx := req.Context()
+	out := req.Clone(ctx)
+	u := *req.URL
+	u.Scheme = "http"
+	out.URL = &u
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	out.ContentLength = int64(len(body))
+	out.TransferEncoding = nil
+	out.Close = false
+	for _, h := range hopHeaders {
+		out.Header.Del(h)
+	}
+	reqBuf := &bytes.Buffer{}
+	if err := out.Write(reqBuf); err != nil {
+		return nil, err
+	}
+
+	c, err := t.client(u.Host)
+	if err != nil {
+		return nil, err
+	}
+	respBuf, err := c.Call(ctx, reqBuf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(respBuf)), req)
+}
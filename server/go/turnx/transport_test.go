@@ -0,0 +1,100 @@
+package turnx
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// trackingBody records whether it was read and closed.
+type trackingBody struct {
+	io.Reader
+	read, closed bool
+}
+
+func (b *trackingBody) Read(p []byte) (int, error) {
+	b.read = true
+	return b.Reader.Read(p)
+}
+
+func (b *trackingBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestTransport(t *testing.T) {
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upgrade", r.Header.Get("Upgrade"))
+		echoHandler(w, r)
+	}))
+	t.Cleanup(remote.Close)
+	target, err := url.Parse(remote.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("secret")
+	addr := serve(t, newTestServerWith(t, Options{
+		Backend: &HTTPBackend{Target: target},
+		Auth:    &RESTAuth{Secret: secret},
+	}))
+	var addrs []string
+	tr := &Transport{NewClient: func(addr string) (*Client, error) {
+		addrs = append(addrs, addr)
+		username, password := RESTCredentials(secret, "alice", time.Hour)
+		return &Client{Addr: addr, Username: username, Password: password, Codec: "zstd"}, nil
+	}}
+	client := &http.Client{Transport: tr}
+
+	resp, err := client.Get("turnx://" + addr + "/path?q=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "GET /path?q=1\n" {
+		t.Errorf("GET: got %d %q", resp.StatusCode, body)
+	}
+
+	req, err := http.NewRequest("POST", "turnx://"+addr+"/echo", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "POST /echo\nhello" || resp.Header.Get("X-Upgrade") != "" {
+		t.Errorf("POST: got %q, Upgrade %q", body, resp.Header.Get("X-Upgrade"))
+	}
+	if len(addrs) != 1 || addrs[0] != addr {
+		t.Errorf("NewClient called for %v, want once for %s", addrs, addr)
+	}
+
+	// other schemes are refused before the body is read
+	b := &trackingBody{Reader: strings.NewReader("unread")}
+	req, err = http.NewRequest("POST", remote.URL, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.RoundTrip(req); err == nil || !strings.Contains(err.Error(), "unsupported protocol scheme") {
+		t.Errorf("http: got %v, want an unsupported scheme", err)
+	}
+	if b.read || !b.closed {
+		t.Errorf("http: body read %v, closed %v", b.read, b.closed)
+	}
+
+	failing := &Transport{NewClient: func(string) (*Client, error) {
+		return nil, errors.New("no credentials")
+	}}
+	if _, err := (&http.Client{Transport: failing}).Get("turnx://" + addr + "/"); err == nil {
+		t.Error("NewClient error ignored")
+	}
+}
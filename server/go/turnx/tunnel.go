@@ -0,0 +1,130 @@
+package turnx
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// maxTunnelRead bounds the downstream data fetched by one Tunnel.Read.
+const maxTunnelRead = 16 << 10
+
+// Tunnel is a stream session opened with Client.Open. What is written to it
+// reaches the server's StreamBackend, and what the backend sends is read
+// from it. Reads and writes may happen concurrently.
+type Tunnel struct {
+	poke  pokeFunc
+	b64id string
+	cfg   callConfig
+
+	wmu  sync.Mutex
+	woff int
+
+	rmu  sync.Mutex
+	roff int    // offset of the end of buf
+	buf  []byte // fetched but not yet read
+	eof  bool
+}
+
+// Open starts a stream session with o:.
+func (c *Client) Open(ctx context.Context) (*Tunnel, error) {
+	cfg, err := c.config(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id, err := c.Poke(ctx, "o:")
+	if err != nil {
+		return nil, err
+	}
+	return &Tunnel{
+		poke:  c.Poke,
+		b64id: base64.StdEncoding.EncodeToString(id),
+		cfg:   cfg,
+	}, nil
+}
+
+// Write uploads p with w:. Each chunk of p is delivered to the backend in
+// one Stream.Send. If the server sends every w: as a datagram, p is never
+// split: Write returns ErrDatagramTooLong if it does not fit a single chunk.
+func (t *Tunnel) Write(p []byte) (int, error) {
+	if t.cfg.datagrams && len(p) > t.cfg.chunkSize {
+		return 0, ErrDatagramTooLong
+	}
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	ctx := context.Background()
+	var jobs []func() error
+	for i := 0; i < len(p); i += t.cfg.chunkSize {
+		req := fmt.Sprintf("w:%s:%d:%s", t.b64id, t.woff+i,
+			base64.StdEncoding.EncodeToString(p[i:min(i+t.cfg.chunkSize, len(p))]))
+		jobs = append(jobs, func() error {
+			_, err := t.poke(ctx, req)
+			return err
+		})
+	}
+	if err := runBatches(jobs); err != nil {
+		return 0, err
+	}
+	t.woff += len(p)
+	return len(p), nil
+}
+
+// Read waits until the backend has sent data, polling with p:, and reads it
+// with r:. It returns io.EOF once the stream has ended and everything has
+// been read.
+func (t *Tunnel) Read(p []byte) (int, error) {
+	t.rmu.Lock()
+	defer t.rmu.Unlock()
+	ctx := context.Background()
+	delay := initialPollDelay
+	for len(t.buf) == 0 {
+		if t.eof {
+			return 0, io.EOF
+		}
+		reply, err := t.poke(ctx, fmt.Sprintf("p:%s:%d", t.b64id, t.roff))
+		if err != nil {
+			return 0, err
+		}
+		if len(reply) != 5 {
+			return 0, errors.New("turnx: invalid stream status")
+		}
+		status := execStatus(reply[0])
+		end := int(binary.BigEndian.Uint32(reply[1:]))
+		if end < t.roff {
+			return 0, errors.New("turnx: invalid stream status")
+		}
+		if end > t.roff {
+			end = min(end, t.roff+maxTunnelRead)
+			t.buf, err = readRange(ctx, t.poke, t.b64id, t.roff, end)
+			if err != nil {
+				return 0, err
+			}
+			t.roff = end
+			break
+		}
+		switch status {
+		case statusClosed:
+			t.eof = true
+			continue
+		case statusPending, statusStreaming:
+		default:
+			return 0, errors.New("turnx: invalid stream status")
+		}
+		time.Sleep(delay)
+		delay = min(delay*2, maxPollDelay)
+	}
+	n := copy(p, t.buf)
+	t.buf = t.buf[n:]
+	return n, nil
+}
+
+// Close ends the stream session with x:.
+func (t *Tunnel) Close() error {
+	_, err := t.poke(context.Background(), "x:"+t.b64id)
+	return err
+}
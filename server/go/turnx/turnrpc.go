@@ -1,22 +1,23 @@
-package main
+package turnx
 
 import (
-	"bufio"
 	"bytes"
-	"compress/zlib"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
-	"io"
-	"net/http"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"runtime/debug"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
-const longReqValidity = 30 * time.Second
 const b64Dict = `
 bmN0aW9uIHIoKXt0cnl7dmFyIHQ9UDtyZXR1cm4gUD1udWxsLHQuYXBwbHkodGhpcyxhcmd1
 bWVudHMpfWNhdGNoKGUpe3JldHVybiBULmU9ZSxUfX1mdW5jdGlvbiBpKHQpe3JldHVybiBQ
@@ -172,21 +173,43 @@ PWFwcGxpY2F0aW9uIDQwMDEgRkxVVEVDb250ZW50LVR5cGU6IGFwcGxpY2F0aW9uL3NkcA0K
 R0VUIC8gSFRUUC8xLjENCkhvc3Q6IGxvY2FsaG9zdDo4MDAwDQo=
 `
 
+// dict is the built-in dictionary, dict/dict.bin in the repository.
 var dict []byte
 
-var longReqValidUntils = make(map[string]time.Time)
-var longReqs = make(map[string][]byte)
-var longResps = make(map[string][]byte)
-var longReqLock sync.Mutex
+// DefaultDictionary returns a copy of the built-in compression dictionary.
+func DefaultDictionary() []byte {
+	return bytes.Clone(dict)
+}
+
+// requestDict picks the dictionary a request was compressed with. It is nil
+// for requests without a preset dictionary.
+func (s *Server) requestDict(c codec, data []byte) ([]byte, error) {
+	id, ok, err := c.dictID(data)
+	if err != nil || !ok {
+		return nil, err
+	}
+	d, ok := s.dicts[id]
+	if !ok {
+		return nil, errors.New("Unknown dictionary")
+	}
+	return d, nil
+}
 
-func reapLong() {
-	longReqLock.Lock()
-	defer longReqLock.Unlock()
-	for id, until := range longReqValidUntils {
+func (s *Server) reapLong() {
+	s.longReqLock.Lock()
+	defer s.longReqLock.Unlock()
+	for id, until := range s.longReqValidUntils {
 		if until.Before(time.Now()) {
-			delete(longReqValidUntils, id)
-			delete(longReqs, id)
-			delete(longResps, id)
+			if st, ok := s.streams[id]; ok {
+				st.close()
+				delete(s.streams, id)
+			}
+			delete(s.longReqValidUntils, id)
+			delete(s.longReqs, id)
+			delete(s.longReqCodecs, id)
+			delete(s.longReqRanges, id)
+			delete(s.longStatuses, id)
+			delete(s.longResps, id)
 		}
 	}
 }
@@ -198,56 +221,167 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
-	go func() {
-		for {
-			reapLong()
-			time.Sleep(time.Second)
-		}
-	}()
+}
 
-	http.DefaultClient.Timeout = 10 * time.Second
+const (
+	idSize = 16
+	// maxRequestSize is the default bound of the compressed request
+	// announced with s:.
+	maxRequestSize = 1 << 20
+	// maxDecompressedSize bounds the request handed to the backend.
+	maxDecompressedSize = 16 << 20
+	// maxChunkSize bounds the content of a single c:. A STUN USERNAME
+	// holds at most 513 bytes, which leaves room for about 350.
+	maxChunkSize = 512
+	// missingPerReply is how many ranges m: returns, as a 4 byte offset and
+	// a 4 byte length each.
+	missingPerReply = 2
+)
+
+// parseID decodes the base64 request id sent by the client.
+func parseID(idStr string) (string, error) {
+	id, err := base64.StdEncoding.Strict().DecodeString(idStr)
+	if err != nil {
+		return "", err
+	}
+	if len(id) != idSize {
+		return "", errors.New("Invalid request id")
+	}
+	return string(id), nil
+}
+
+// parseOffset decodes a decimal offset and checks that 0 <= offset <= max.
+func parseOffset(offsetStr string, max int) (int, error) {
+	offset, err := strconv.ParseUint(offsetStr, 10, 31)
+	if err != nil {
+		return 0, err
+	}
+	if int(offset) > max {
+		return 0, errors.New("Invalid offset")
+	}
+	return int(offset), nil
 }
 
-func turnx(req []byte) []byte {
-	httpReq, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(req)))
-	wr := &bytes.Buffer{}
+// verifyChecksum checks content against the hex encoded CRC-32 (IEEE) or
+// SHA-256 sent with e:, telling them apart by length.
+func verifyChecksum(content []byte, sum string) error {
+	want, err := hex.DecodeString(sum)
 	if err != nil {
-		errResp := http.Response{
-			StatusCode: 400,
-			ProtoMajor: 1,
-			ProtoMinor: 1,
+		return err
+	}
+	var got []byte
+	switch len(want) {
+	case crc32.Size:
+		got = binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE(content))
+	case sha256.Size:
+		h := sha256.Sum256(content)
+		got = h[:]
+	default:
+		return errors.New("Invalid checksum")
+	}
+	if !bytes.Equal(got, want) {
+		return errors.New("Checksum mismatch")
+	}
+	return nil
+}
+
+// execStatus is the first byte of the replies to e: and p:. A done status
+// is followed by the 4 byte big-endian length of the compressed response.
+type execStatus byte
+
+const (
+	statusPending execStatus = iota
+	statusDone
+	statusFailed
+	// statusStreaming and statusClosed describe stream sessions, and are
+	// followed by the end offset of the downstream data.
+	statusStreaming
+	statusClosed
+)
+
+// statusReply returns the reply describing the execution of id.
+func (s *Server) statusReply(id string) []byte {
+	status := s.longStatuses[id]
+	if status != statusDone {
+		return []byte{byte(status)}
+	}
+	return binary.BigEndian.AppendUint32([]byte{byte(status)}, uint32(len(s.longResps[id])))
+}
+
+// execute runs the backend and compresses its response in the background,
+// recording the outcome under id unless the request has expired meanwhile.
+// The outcome is retained so that retried e: and r: can be answered.
+func (s *Server) execute(ctx context.Context, id string, c codec, d []byte, req []byte) {
+	// a panic on the way, in the cache, compression or below, fails the
+	// request instead of the server
+	defer func() {
+		if r := recover(); r != nil {
+			s.errorLog.Printf("turnx: panic executing request: %v\n%s", r, debug.Stack())
+			s.longReqLock.Lock()
+			defer s.longReqLock.Unlock()
+			if _, ok := s.longReqValidUntils[id]; ok {
+				s.longReqValidUntils[id] = time.Now().Add(s.validity)
+				s.longStatuses[id] = statusFailed
+			}
 		}
-		errResp.Write(wr)
-		return wr.Bytes()
+	}()
+	resp, err := s.respond(ctx, c, d, req)
+	s.longReqLock.Lock()
+	defer s.longReqLock.Unlock()
+	if _, ok := s.longReqValidUntils[id]; !ok {
+		return
 	}
+	// keep the outcome for a full validity period, however long it took
+	s.longReqValidUntils[id] = time.Now().Add(s.validity)
+	if err != nil {
+		s.errorLog.Println(err)
+		s.longStatuses[id] = statusFailed
+		return
+	}
+	s.longResps[id] = resp
+	s.longStatuses[id] = statusDone
+}
 
-	httpReq.Header.Del("Host")
-	httpReq.Host = targetUrl.Host
-	httpReq.URL.Host = targetUrl.Host
-	httpReq.URL.Scheme = targetUrl.Scheme
-	httpReq.URL.Path = targetUrl.Path
-	httpReq.RequestURI = ""
+// respond answers req from the cache if there is one, and from the backend
+// otherwise. The response is compressed with c and d.
+func (s *Server) respond(ctx context.Context, c codec, d []byte, req []byte) ([]byte, error) {
+	if s.cache != nil {
+		return s.cache.respond(ctx, s, c, d, req)
+	}
+	_, comped, err := s.fetch(ctx, c, d, req)
+	return comped, err
+}
 
-	httpResp, err := http.DefaultClient.Do(httpReq)
+// fetch calls the backend, returning its response both as is and compressed
+// with c and d.
+func (s *Server) fetch(ctx context.Context, c codec, d []byte, req []byte) (resp, comped []byte, err error) {
+	resp, err = s.callBackend(ctx, req)
 	if err != nil {
-		errResp := http.Response{
-			StatusCode: http.StatusBadGateway,
-			ProtoMajor: 1,
-			ProtoMinor: 1,
-		}
-		if err == http.ErrHandlerTimeout {
-			errResp.StatusCode = http.StatusGatewayTimeout
-		}
-		errResp.Write(wr)
-		return wr.Bytes()
+		return nil, nil, err
 	}
-	httpResp.Write(wr)
-	return wr.Bytes()
+	comped, err = c.compress(resp, d)
+	return resp, comped, err
+}
+
+// callBackend turns a panicking backend into an error.
+func (s *Server) callBackend(ctx context.Context, req []byte) (resp []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Backend panic: %v", r)
+		}
+	}()
+	return s.backend.Execute(ctx, req)
 }
 
-func turnpoke(req string) ([]byte, error) {
-	longReqLock.Lock()
-	defer longReqLock.Unlock()
+// errRateLimited is returned by turnpoke when starting backend work would
+// exceed the RateLimits.
+var errRateLimited = errors.New("Rate limited")
+
+// turnpoke runs a single turnrpc request of user from ip and returns the
+// reply.
+func (s *Server) turnpoke(ip net.IP, user *Identity, req string) ([]byte, error) {
+	s.longReqLock.Lock()
+	defer s.longReqLock.Unlock()
 	parts := strings.SplitN(req, ":", 2)
 	if len(parts) != 2 {
 		return nil, errors.New("Invalid request")
@@ -255,111 +389,173 @@ func turnpoke(req string) ([]byte, error) {
 	method := parts[0]
 	args := parts[1]
 	switch method {
-	case "s": // start a longer request, args is the dec encoded length of the content
-		l, err := strconv.ParseInt(args, 10, 64)
+	case "v": // describe what the server supports
+		if args != "" {
+			return nil, errors.New("Invalid request")
+		}
+		return s.capabilities().marshal(), nil
+	case "s": // start a longer request, args is the dec encoded length of the content and optionally the codec
+		if s.backend == nil {
+			return nil, errors.New("Unknown method")
+		}
+		parts := strings.SplitN(args, ":", 2)
+		l, err := parseOffset(parts[0], s.maxReqSize)
 		if err != nil {
 			return nil, err
 		}
-		id := make([]byte, 16) // 16 bytes of random data, 128 bits, probably enough
+		c := codecZlib
+		if len(parts) == 2 {
+			c, err = parseCodec(parts[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		id := make([]byte, idSize) // 16 bytes of random data, 128 bits, probably enough
 		rand.Read(id)
-		longReqs[string(id)] = make([]byte, l)
-		longReqValidUntils[string(id)] = time.Now().Add(longReqValidity)
+		s.longReqs[string(id)] = make([]byte, l)
+		s.longReqCodecs[string(id)] = c
+		s.longReqValidUntils[string(id)] = time.Now().Add(s.validity)
 		return id, nil // return the id of the request
 	case "c": // set content of the longer request
 		parts := strings.SplitN(args, ":", 3)
-		idStr := parts[0]
-		id, err := base64.StdEncoding.DecodeString(idStr)
+		if len(parts) != 3 {
+			return nil, errors.New("Invalid request")
+		}
+		id, err := parseID(parts[0])
 		if err != nil {
 			return nil, err
 		}
-		offsetStr := parts[1]
-		offset64, err := strconv.ParseInt(offsetStr, 10, 64)
-		offset := int(offset64)
+		long, ok := s.longReqs[id]
+		if !ok {
+			return nil, errors.New("Unknown request")
+		}
+		offset, err := parseOffset(parts[1], len(long))
 		if err != nil {
 			return nil, err
 		}
-		contentStr := parts[2]
-		content, err := base64.StdEncoding.DecodeString(contentStr)
+		if base64.StdEncoding.DecodedLen(len(parts[2])) > maxChunkSize {
+			return nil, errors.New("Content too long")
+		}
+		content, err := base64.StdEncoding.Strict().DecodeString(parts[2])
 		if err != nil {
 			return nil, err
 		}
-		long := longReqs[string(id)]
-		if long == nil {
-			return nil, errors.New("Unknown request")
-		}
-		maxLen := len(long) - offset
-		if len(content) > maxLen {
+		if len(content) > len(long)-offset {
 			return nil, errors.New("Content too long")
 		}
 		copy(long[offset:], content)
-		return id, nil
-	case "e": // execute a longer request
-		idStr := args
-		id, err := base64.StdEncoding.DecodeString(idStr)
+		s.longReqRanges[id] = s.longReqRanges[id].add(offset, offset+len(content))
+		return []byte(id), nil
+	case "m": // list the ranges of a longer request not received yet, optionally from an offset
+		parts := strings.SplitN(args, ":", 2)
+		id, err := parseID(parts[0])
 		if err != nil {
 			return nil, err
 		}
-		longReq := longReqs[string(id)]
-		if longReq == nil {
+		long, ok := s.longReqs[id]
+		if !ok {
 			return nil, errors.New("Unknown request")
 		}
-		// zlib-decompress the request
-		r, err := zlib.NewReaderDict(bytes.NewReader(longReq), dict)
-		if err != nil {
-			return nil, err
+		from := 0
+		if len(parts) == 2 {
+			from, err = parseOffset(parts[1], len(long))
+			if err != nil {
+				return nil, err
+			}
+		}
+		var out []byte
+		for _, r := range s.longReqRanges[id].missing(from, len(long), missingPerReply) {
+			out = binary.BigEndian.AppendUint32(out, uint32(r.start))
+			out = binary.BigEndian.AppendUint32(out, uint32(r.end-r.start))
 		}
-		decomped, err := io.ReadAll(r)
+		return out, nil
+	case "e": // execute a longer request, optionally verifying a checksum of its content
+		parts := strings.SplitN(args, ":", 2)
+		id, err := parseID(parts[0])
 		if err != nil {
 			return nil, err
 		}
-
-		delete(longReqs, string(id))
-		// Unlock during the request
-		longReqLock.Unlock()
-		longResp := turnx(decomped)
-		longReqLock.Lock()
-
-		// Check if the request still exists, if not, return an error
-		if _, ok := longReqValidUntils[string(id)]; !ok {
+		// repeated e: only report the status, the backend runs once
+		if _, ok := s.longStatuses[id]; ok {
+			return s.statusReply(id), nil
+		}
+		longReq, ok := s.longReqs[id]
+		if !ok {
 			return nil, errors.New("Unknown request")
 		}
-
-		// zlib-compress the response
-		w := &bytes.Buffer{}
-		z, err := zlib.NewWriterLevelDict(w, zlib.BestCompression, dict)
+		if len(s.longReqRanges[id].missing(0, len(longReq), 1)) != 0 {
+			return nil, errors.New("Incomplete request")
+		}
+		if len(parts) == 2 {
+			if err := verifyChecksum(longReq, parts[1]); err != nil {
+				return nil, err
+			}
+		}
+		// take the execute token first, decompressing is work too
+		if !s.limiter.allowExecute(ip, user, parts[0]) {
+			return nil, errRateLimited
+		}
+		// decompress the request with the dictionary named in its header
+		c := s.longReqCodecs[id]
+		d, err := s.requestDict(c, longReq)
 		if err != nil {
 			return nil, err
 		}
-		_, err = z.Write(longResp)
+		decomped, err := c.decompress(longReq, d, maxDecompressedSize)
+		if err != nil {
+			return nil, err
+		}
+
+		delete(s.longReqs, id)
+		delete(s.longReqCodecs, id)
+		delete(s.longReqRanges, id)
+		s.longStatuses[id] = statusPending
+		// run the request in the background, the client polls with p:
+		ctx, cancel := context.WithDeadline(withUser(s.ctx, user), s.longReqValidUntils[id])
+		go func() {
+			defer cancel()
+			s.execute(ctx, id, c, d, decomped)
+		}()
+		return s.statusReply(id), nil
+	case "o", "w", "x":
+		return s.streamPoke(ip, user, method, args)
+	case "p": // poll the status of an executed request
+		if s.isStream(args) {
+			return s.streamPoke(ip, user, method, args)
+		}
+		id, err := parseID(args)
 		if err != nil {
 			return nil, err
 		}
-		err = z.Close()
-		comped := w.Bytes()
-		longResps[string(id)] = comped
-		lenBytes := make([]byte, 4)
-		binary.BigEndian.PutUint32(lenBytes, uint32(len(comped)))
-		return lenBytes, nil
+		if _, ok := s.longStatuses[id]; !ok {
+			return nil, errors.New("Unknown request")
+		}
+		return s.statusReply(id), nil
+	case "q": // take the next message of a mailbox, args is the name of the mailbox
+		if args == "" {
+			return nil, errors.New("Invalid request")
+		}
+		return s.takeMessage(args), nil
 	case "r": // get the content of a longer response
+		if s.isStream(args) {
+			return s.streamPoke(ip, user, method, args)
+		}
 		parts := strings.SplitN(args, ":", 2)
 		if len(parts) != 2 {
 			return nil, errors.New("Invalid request")
 		}
-		idStr := parts[0]
-		id, err := base64.StdEncoding.DecodeString(idStr)
+		id, err := parseID(parts[0])
 		if err != nil {
 			return nil, err
 		}
-		offsetStr := parts[1]
-		offset64, err := strconv.ParseInt(offsetStr, 10, 64)
-		offset := int(offset64)
+		long, ok := s.longResps[id]
+		if !ok {
+			return nil, errors.New("Unknown request")
+		}
+		offset, err := parseOffset(parts[1], len(long))
 		if err != nil {
 			return nil, err
 		}
-		long := longResps[string(id)]
-		if long == nil {
-			return nil, errors.New("Unknown request")
-		}
 		out := long[offset:]
 		if len(out) > 16 {
 			out = out[:16]
@@ -0,0 +1,181 @@
+package turnx
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDictionaries(t *testing.T) {
+	retrained := append([]byte("GET POST HTTP/1.1 Content-Type: "), dict[:1024]...)
+	addr := serve(t, newTestServerWith(t, Options{
+		Backend:      &HandlerBackend{Handler: echoHandler},
+		Dictionaries: [][]byte{retrained, dict},
+	}))
+
+	req := []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	for _, d := range [][]byte{nil, retrained, {}} {
+		for _, c := range codecNames {
+			client := &Client{Addr: addr, Dictionary: d, Codec: c}
+			resp, err := client.Call(context.Background(), req)
+			if err != nil {
+				t.Fatalf("%s dictionary of %d bytes: %v", c, len(d), err)
+			}
+			if !bytes.Contains(resp, []byte("GET /\n")) {
+				t.Errorf("%s dictionary of %d bytes: got %q", c, len(d), resp)
+			}
+		}
+	}
+
+	client := &Client{Addr: addr, Dictionary: []byte("unknown")}
+	if _, err := client.Call(context.Background(), req); !errors.Is(err, ErrRejected) {
+		t.Errorf("unknown dictionary: got %v, want ErrRejected", err)
+	}
+	caps, err := client.Capabilities(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps.DictID != adler32.Checksum(retrained) {
+		t.Errorf("v: reported dictionary %08x, want %08x", caps.DictID, adler32.Checksum(retrained))
+	}
+}
+
+func TestSlowBackend(t *testing.T) {
+	addr := startServer(t, &HandlerBackend{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+		echoHandler(w, r)
+	})})
+	client := &Client{Addr: addr, Timeout: 500 * time.Millisecond}
+	resp, err := client.Call(context.Background(), []byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(resp, []byte("GET /slow\n")) {
+		t.Errorf("got %q", resp)
+	}
+}
+
+func TestLostChunks(t *testing.T) {
+	addr := startServer(t, &HandlerBackend{Handler: echoHandler})
+	client := &Client{Addr: addr}
+	var mu sync.Mutex
+	dropped := map[string]bool{}
+	// drop the first attempt of every other chunk
+	lossy := func(ctx context.Context, req string) ([]byte, error) {
+		mu.Lock()
+		drop := strings.HasPrefix(req, "c:") && len(dropped)%2 == 0 && !dropped[req]
+		if strings.HasPrefix(req, "c:") && !dropped[req] {
+			dropped[req] = drop
+		}
+		mu.Unlock()
+		if drop {
+			return nil, errors.New("lost")
+		}
+		return client.Poke(ctx, req)
+	}
+
+	random := make([]byte, 4000)
+	rand.Read(random)
+	body := base64.StdEncoding.EncodeToString(random)
+	req := fmt.Sprintf("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	cfg := callConfig{chunkSize: reqPartSize, dict: dict, verify: true}
+	resp, err := call(context.Background(), []byte(req), lossy, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(resp, []byte(body)) {
+		t.Errorf("got %q", resp)
+	}
+
+	ctx := context.Background()
+	id, err := client.Poke(ctx, "s:8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64id := base64.StdEncoding.EncodeToString(id)
+	if _, err := client.Poke(ctx, "c:"+b64id+":2:AAAA"); err != nil {
+		t.Fatal(err)
+	}
+	missing, err := missingRanges(ctx, client.Poke, b64id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []span{{0, 2}, {5, 8}}; !slices.Equal(missing, want) {
+		t.Errorf("m: returned %v, want %v", missing, want)
+	}
+	if _, err := client.Poke(ctx, "e:"+b64id); !errors.Is(err, ErrRejected) {
+		t.Errorf("e: of an incomplete request: got %v, want ErrRejected", err)
+	}
+}
+
+func TestRepeatedExecute(t *testing.T) {
+	var calls atomic.Int32
+	addr := startServer(t, &HandlerBackend{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		echoHandler(w, r)
+	})})
+	client := &Client{Addr: addr}
+	ctx := context.Background()
+
+	comped, err := codecZlib.compress([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\n\r\n"), dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := client.Poke(ctx, fmt.Sprintf("s:%d", len(comped)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64id := base64.StdEncoding.EncodeToString(id)
+	if _, err := client.Poke(ctx, fmt.Sprintf("c:%s:0:%s", b64id, base64.StdEncoding.EncodeToString(comped))); err != nil {
+		t.Fatal(err)
+	}
+	var lengths []int
+	for range 3 {
+		n, err := waitResponse(ctx, client.Poke, "e:"+b64id, b64id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lengths = append(lengths, n)
+	}
+	if lengths[0] != lengths[1] || lengths[1] != lengths[2] {
+		t.Errorf("repeated e: returned lengths %v", lengths)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("backend called %d times, want 1", n)
+	}
+}
+
+// panicContext panics when a value is looked up, as the cache does for the
+// user of a request.
+type panicContext struct{ context.Context }
+
+func (panicContext) Value(any) any { panic("value") }
+
+func TestExecutePanic(t *testing.T) {
+	s := newTestServerWith(t, Options{
+		Backend:   &HandlerBackend{Handler: echoHandler},
+		CacheSize: 1 << 20,
+	})
+	id := "panic"
+	s.longReqLock.Lock()
+	s.longReqValidUntils[id] = time.Now().Add(time.Minute)
+	s.longStatuses[id] = statusPending
+	s.longReqLock.Unlock()
+	s.execute(panicContext{context.Background()}, id, codecZlib, nil, []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	s.longReqLock.Lock()
+	defer s.longReqLock.Unlock()
+	if s.longStatuses[id] != statusFailed {
+		t.Errorf("got status %d, want failed", s.longStatuses[id])
+	}
+}
@@ -0,0 +1,67 @@
+package turnx
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// maxDatagramSize is the largest UDP payload.
+const maxDatagramSize = 65535
+
+// UDPBackend is a StreamBackend that sends datagrams to Addr, from a socket
+// of its own for every stream session. Each w: is sent as one datagram, and
+// every reply datagram is read as a frame: a 4 byte big-endian length
+// followed by the datagram.
+type UDPBackend struct {
+	// Addr is the host:port to send to.
+	Addr string
+	// Dialer defaults to a zero net.Dialer.
+	Dialer *net.Dialer
+}
+
+func (b *UDPBackend) datagrams() {}
+
+func (b *UDPBackend) Open(ctx context.Context) (Stream, error) {
+	dialer := b.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	conn, err := dialer.DialContext(ctx, "udp", b.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpStream{conn: conn}, nil
+}
+
+type udpStream struct {
+	conn net.Conn
+}
+
+func (u *udpStream) Send(p []byte) error {
+	_, err := u.conn.Write(p)
+	return err
+}
+
+func (u *udpStream) Receive() ([]byte, error) {
+	buf := make([]byte, 4+maxDatagramSize)
+	for {
+		n, err := u.conn.Read(buf[4:])
+		// an ICMP port unreachable surfaces as a read error on connected
+		// sockets, but the backend may yet come back
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint32(buf, uint32(n))
+		return buf[:4+n], nil
+	}
+}
+
+func (u *udpStream) Close() error {
+	return u.conn.Close()
+}
@@ -0,0 +1,80 @@
+package turnx
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUDPStream(t *testing.T) {
+	backend, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			backend.WriteTo(bytes.ToUpper(buf[:n]), addr)
+		}
+	}()
+	addr := serve(t, newTestServerWith(t, Options{
+		StreamBackend: &UDPBackend{Addr: backend.LocalAddr().String()},
+		Validity:      time.Hour,
+	}))
+	client := &Client{Addr: addr}
+	tunnel, err := client.Open(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	for _, datagram := range []string{"query one", "query two"} {
+		if _, err := tunnel.Write([]byte(datagram)); err != nil {
+			t.Fatal(err)
+		}
+		var n uint32
+		if err := binary.Read(tunnel, binary.BigEndian, &n); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, n)
+		if _, err := io.ReadFull(tunnel, got); err != nil {
+			t.Fatal(err)
+		}
+		if want := strings.ToUpper(datagram); string(got) != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+
+	// a write is sent as one datagram, so it has to fit a single chunk
+	caps, err := client.Capabilities(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !caps.Datagrams {
+		t.Error("v: does not report datagrams")
+	}
+	if _, err := tunnel.Write(make([]byte, tunnel.cfg.chunkSize+1)); !errors.Is(err, ErrDatagramTooLong) {
+		t.Errorf("write beyond a chunk: got %v, want ErrDatagramTooLong", err)
+	}
+	if _, err := tunnel.Write(bytes.Repeat([]byte("x"), tunnel.cfg.chunkSize)); err != nil {
+		t.Fatal(err)
+	}
+	var n uint32
+	if err := binary.Read(tunnel, binary.BigEndian, &n); err != nil {
+		t.Fatal(err)
+	}
+	if int(n) != tunnel.cfg.chunkSize {
+		t.Errorf("got a datagram of %d bytes, want %d", n, tunnel.cfg.chunkSize)
+	}
+}
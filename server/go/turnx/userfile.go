@@ -0,0 +1,140 @@
+package turnx
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// userFileCheckInterval bounds how often a UserFile looks for changes.
+const userFileCheckInterval = time.Second
+
+// UserFile authenticates the users listed in a file in the format of coturn's
+// userdb, one user per line:
+//
+//	# comment
+//	alice:0x0123456789abcdef0123456789abcdef backend=api,web rate=10
+//	bob:password
+//
+// The key after the colon is either the long-term key, MD5 of
+// "<user>:<realm>:<password>" in hex, or the password itself. It may be
+// followed by attributes, which are passed on in Identity.Attrs. The rate
+// attribute, see RateLimits, must be a positive number.
+//
+// The USERNAME of requests is the user alone, so the turnrpc request travels
+// in the TURNRPC attribute instead, which browsers can not send. The file is
+// reloaded when it changes; if it has become invalid, the users loaded last
+// stay in effect.
+type UserFile struct {
+	path     string
+	errorLog *log.Logger
+	now      func() time.Time
+
+	mu      sync.Mutex
+	users   map[string]*Identity
+	modTime time.Time
+	checked time.Time
+}
+
+// NewUserFile loads the users in the file at path. Errors reloading it are
+// logged to errorLog, or the log package's standard logger if nil.
+func NewUserFile(path string, errorLog *log.Logger) (*UserFile, error) {
+	if errorLog == nil {
+		errorLog = log.Default()
+	}
+	f := &UserFile{path: path, errorLog: errorLog, now: time.Now}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *UserFile) Authenticate(username string) (*Identity, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if now := f.now(); now.Sub(f.checked) >= userFileCheckInterval {
+		f.checked = now
+		if err := f.load(); err != nil {
+			f.errorLog.Println(err)
+		}
+	}
+	id, ok := f.users[username]
+	if !ok {
+		return nil, errors.New("Unknown user")
+	}
+	return id, nil
+}
+
+// load reads the file if it has changed since it was last read.
+func (f *UserFile) load() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if f.users != nil && info.ModTime().Equal(f.modTime) {
+		return nil
+	}
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	users, err := parseUserFile(b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.path, err)
+	}
+	f.users = users
+	f.modTime = info.ModTime()
+	return nil
+}
+
+func parseUserFile(b []byte) (map[string]*Identity, error) {
+	users := make(map[string]*Identity)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		user, key, ok := strings.Cut(fields[0], ":")
+		if !ok || user == "" || key == "" {
+			return nil, fmt.Errorf("line %d: expected <user>:<key>", n)
+		}
+		if _, ok := users[user]; ok {
+			return nil, fmt.Errorf("line %d: duplicate user %q", n, user)
+		}
+		id := &Identity{User: user, Attrs: make(map[string]string)}
+		if hexKey, ok := strings.CutPrefix(key, "0x"); ok {
+			k, err := hex.DecodeString(hexKey)
+			if err != nil || len(k) != 16 {
+				return nil, fmt.Errorf("line %d: key is not 16 bytes of hex", n)
+			}
+			id.Key = k
+		} else {
+			id.Password = key
+		}
+		for _, attr := range fields[1:] {
+			name, value, ok := strings.Cut(attr, "=")
+			if !ok || name == "" {
+				return nil, fmt.Errorf("line %d: expected <name>=<value>, got %q", n, attr)
+			}
+			if name == "rate" {
+				if r, err := strconv.ParseFloat(value, 64); err != nil || !(r > 0) || math.IsInf(r, 1) {
+					return nil, fmt.Errorf("line %d: rate must be a positive number, got %q", n, value)
+				}
+			}
+			id.Attrs[name] = value
+		}
+		users[user] = id
+	}
+	return users, scanner.Err()
+}
@@ -0,0 +1,125 @@
+package turnx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserFile(t *testing.T) {
+	key := md5.Sum([]byte("alice:" + defaultRealm + ":secret"))
+	path := filepath.Join(t.TempDir(), "users")
+	users := fmt.Sprintf("# users\nalice:0x%x\nbob:hunter2 backend=web\n", key)
+	if err := os.WriteFile(path, []byte(users), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewUserFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := newTestClock()
+	auth.now = clock.Now
+	whoami := &HandlerBackend{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := UserFromContext(r.Context())
+		fmt.Fprintf(w, "%s %s", user.User, r.URL.Path)
+	})}
+	addr := serve(t, newTestServerWith(t, Options{
+		Backend: &Router{Routes: []Route{
+			{Name: "api", PathPrefix: "/api", Backend: whoami},
+			{Name: "web", Backend: whoami},
+		}},
+		Auth: auth,
+	}))
+	ctx := context.Background()
+	get := func(user, password, path string) (string, error) {
+		t.Helper()
+		client := &Client{Addr: addr, Username: user, Password: password, Attribute: true, Timeout: time.Second}
+		resp, err := client.Call(ctx, []byte("GET "+path+" HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		if err != nil {
+			return "", err
+		}
+		httpResp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(resp)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(httpResp.Body)
+		return fmt.Sprintf("%d %s", httpResp.StatusCode, body), nil
+	}
+	for _, tc := range []struct{ user, password, path, want string }{
+		{"alice", "secret", "/api/x", "200 alice /api/x"},
+		{"bob", "hunter2", "/", "200 bob /"},
+		{"bob", "hunter2", "/api/x", "403 "},
+	} {
+		got, err := get(tc.user, tc.password, tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(got, tc.want) {
+			t.Errorf("%s %s: got %q, want %q", tc.user, tc.path, got, tc.want)
+		}
+	}
+	if _, err := get("alice", "wrong", "/"); !errors.Is(err, ErrRejected) {
+		t.Errorf("wrong password: got %v, want ErrRejected", err)
+	}
+
+	// bob is gone once the file has been reloaded
+	if err := os.WriteFile(path, []byte(users[:strings.Index(users, "bob")]), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(path, future, future)
+	clock.Advance(userFileCheckInterval)
+	if _, err := get("bob", "hunter2", "/"); !errors.Is(err, ErrRejected) {
+		t.Errorf("removed user: got %v, want ErrRejected", err)
+	}
+}
+
+func TestParseUserFile(t *testing.T) {
+	users, err := parseUserFile([]byte("  # comment\n\nalice:0x000102030405060708090a0b0c0d0e0f rate=5 backend=\n\tbob:pass:word\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, bob := users["alice"], users["bob"]
+	if len(users) != 2 || alice == nil || bob == nil {
+		t.Fatalf("got users %v", users)
+	}
+	if len(alice.Key) != 16 || alice.Key[15] != 0x0f || alice.Attrs["rate"] != "5" {
+		t.Errorf("alice: got %+v", alice)
+	}
+	if v, ok := alice.Attrs["backend"]; !ok || v != "" {
+		t.Errorf("alice: empty attribute lost")
+	}
+	if bob.Password != "pass:word" || bob.Key != nil {
+		t.Errorf("bob: got %+v", bob)
+	}
+
+	for _, tc := range []struct{ file, err string }{
+		{"alice", "line 1: expected <user>:<key>"},
+		{":key", "line 1: expected <user>:<key>"},
+		{"# ok\nalice:", "line 2: expected <user>:<key>"},
+		{"alice:a\nalice:b", `line 2: duplicate user "alice"`},
+		{"alice:0x0011", "line 1: key is not 16 bytes of hex"},
+		{"alice:0xzz0102030405060708090a0b0c0d0e0f", "line 1: key is not 16 bytes of hex"},
+		{"alice:a rate", `line 1: expected <name>=<value>, got "rate"`},
+		{"alice:a =5", `line 1: expected <name>=<value>, got "=5"`},
+		{"alice:a rate=0", `line 1: rate must be a positive number, got "0"`},
+		{"alice:a rate=-1", `line 1: rate must be a positive number, got "-1"`},
+		{"alice:a rate=fast", `line 1: rate must be a positive number, got "fast"`},
+		{"alice:a rate=NaN", `line 1: rate must be a positive number, got "NaN"`},
+		{"alice:a rate=+Inf", `line 1: rate must be a positive number, got "+Inf"`},
+	} {
+		if _, err := parseUserFile([]byte(tc.file)); err == nil || err.Error() != tc.err {
+			t.Errorf("%q: got %v, want %q", tc.file, err, tc.err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package turnx
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxFrameSize bounds a single WebSocket message.
+const maxFrameSize = 1 << 20
+
+// textFrame marks text messages in the length prefix of a frame.
+const textFrame = 1 << 31
+
+// WebSocketBackend is a StreamBackend that opens a WebSocket to Target for
+// every stream session. Messages travel as frames in both directions: a 4
+// byte big-endian length followed by the message, with the top bit of the
+// length set for text messages.
+type WebSocketBackend struct {
+	Target *url.URL
+	// Header is sent with the opening handshake.
+	Header http.Header
+	// Dialer defaults to websocket.DefaultDialer.
+	Dialer *websocket.Dialer
+}
+
+func (b *WebSocketBackend) Open(ctx context.Context) (Stream, error) {
+	dialer := b.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	conn, resp, err := dialer.DialContext(ctx, b.Target.String(), b.Header)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	conn.SetReadLimit(maxFrameSize)
+	return &wsStream{conn: conn}, nil
+}
+
+type wsStream struct {
+	conn *websocket.Conn
+	buf  []byte // the incomplete frame uploaded so far
+}
+
+func (w *wsStream) Send(p []byte) error {
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= 4 {
+		n := binary.BigEndian.Uint32(w.buf)
+		typ := websocket.BinaryMessage
+		if n&textFrame != 0 {
+			typ = websocket.TextMessage
+			n &^= textFrame
+		}
+		if n > maxFrameSize {
+			return errors.New("turnx: frame too long")
+		}
+		if len(w.buf) < 4+int(n) {
+			break
+		}
+		if err := w.conn.WriteMessage(typ, w.buf[4:4+n]); err != nil {
+			return err
+		}
+		w.buf = w.buf[4+n:]
+	}
+	return nil
+}
+
+func (w *wsStream) Receive() ([]byte, error) {
+	typ, msg, err := w.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	n := uint32(len(msg))
+	if typ == websocket.TextMessage {
+		n |= textFrame
+	}
+	return append(binary.BigEndian.AppendUint32(nil, n), msg...), nil
+}
+
+func (w *wsStream) Close() error {
+	return w.conn.Close()
+}
@@ -0,0 +1,90 @@
+package turnx
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsEchoHandler echoes every WebSocket message with its type.
+var wsEchoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	for {
+		typ, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := conn.WriteMessage(typ, msg); err != nil {
+			return
+		}
+	}
+})
+
+func TestWebSocketStream(t *testing.T) {
+	ws := httptest.NewServer(wsEchoHandler)
+	t.Cleanup(ws.Close)
+	target, _ := url.Parse("ws" + strings.TrimPrefix(ws.URL, "http"))
+	addr := serve(t, newTestServerWith(t, Options{
+		StreamBackend: &WebSocketBackend{Target: target},
+		Validity:      time.Hour,
+	}))
+	client := &Client{Addr: addr}
+	tunnel, err := client.Open(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := make([]byte, 3000)
+	rand.Read(large)
+	frames := []struct {
+		text bool
+		msg  []byte
+	}{
+		{true, []byte(`{"hello":"world"}`)},
+		{false, large},
+		{false, nil},
+	}
+	var upload []byte
+	for _, f := range frames {
+		n := uint32(len(f.msg))
+		if f.text {
+			n |= textFrame
+		}
+		upload = binary.BigEndian.AppendUint32(upload, n)
+		upload = append(upload, f.msg...)
+	}
+	// split the upload so that frames straddle writes
+	for i := 0; i < len(upload); i += 1000 {
+		if _, err := tunnel.Write(upload[i:min(i+1000, len(upload))]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := make([]byte, len(upload))
+	if _, err := io.ReadFull(tunnel, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, upload) {
+		t.Errorf("echoed frames differ")
+	}
+	if err := tunnel.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tunnel.Write([]byte("late")); !errors.Is(err, ErrRejected) {
+		t.Errorf("write after close: got %v, want ErrRejected", err)
+	}
+}